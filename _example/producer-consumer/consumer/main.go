@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/golang-queue/nsq"
@@ -32,7 +33,7 @@ func main() {
 	m := graceful.NewManager()
 
 	// define the worker
-	w := nsq.NewWorker(
+	w, err := nsq.NewWorker(
 		nsq.WithAddr("127.0.0.1:4150"),
 		nsq.WithTopic("example"),
 		nsq.WithChannel("foobar"),
@@ -48,6 +49,9 @@ func main() {
 			return nil
 		}),
 	)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// define the queue
 	q := queue.NewPool(
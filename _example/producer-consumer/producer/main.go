@@ -26,11 +26,14 @@ func main() {
 	taskN := 5
 
 	// define the worker
-	w := nsq.NewWorker(
+	w, err := nsq.NewWorker(
 		nsq.WithAddr("127.0.0.1:4150"),
 		nsq.WithTopic("example"),
 		nsq.WithChannel("foobar"),
 	)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// define the queue
 	q := queue.NewPool(
@@ -29,7 +29,7 @@ func main() {
 	rets := make(chan string, taskN)
 
 	// define the worker
-	w := nsq.NewWorker(
+	w, err := nsq.NewWorker(
 		nsq.WithAddr("127.0.0.1:4150"),
 		nsq.WithTopic("example"),
 		nsq.WithChannel("foobar"),
@@ -44,6 +44,9 @@ func main() {
 			return nil
 		}),
 	)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// define the queue
 	q := queue.NewPool(
@@ -0,0 +1,60 @@
+package nsq
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// nsqdHTTPTimeout bounds the requests to the HTTP API of nsqd and nsqlookupd
+const nsqdHTTPTimeout = 5 * time.Second
+
+// createTopic creates the topic with the HTTP API of the nsqd at addr,
+// it's a no-op for an existing topic
+func createTopic(addr, topic string) error {
+	return nsqdPost(addr, "/topic/create", url.Values{"topic": {topic}})
+}
+
+// createChannel creates the channel of the topic with the HTTP API of the nsqd at addr,
+// the channel keeps the messages published from then on
+func createChannel(addr, topic, channel string) error {
+	return nsqdPost(addr, "/channel/create", url.Values{"topic": {topic}, "channel": {channel}})
+}
+
+// pingLookupd checks the HTTP API of the nsqlookupd at addr is up
+func pingLookupd(addr string) error {
+	return httpCall("nsqlookupd", http.MethodGet, addr, "/ping", nil)
+}
+
+func nsqdPost(addr, path string, params url.Values) error {
+	return httpCall("nsqd", http.MethodPost, addr, path, params)
+}
+
+func httpCall(server, method, addr, path string, params url.Values) error {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest(method, addr+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: nsqdHTTPTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s returned %s: %s", server, path, resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package nsq
+
+import "sync/atomic"
+
+// backpressure applies the running jobs to the max in flight of the consumers, see WithBackpressure
+func (w *Worker) backpressure() {
+	if !w.opts.backpressure || atomic.LoadInt32(&w.stopFlag) == 1 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if atomic.LoadInt32(&w.paused) == 1 {
+		return
+	}
+
+	for _, sub := range w.subs {
+		conns := sub.q.Stats().Connections
+		n := w.maxInFlight(sub, conns)
+		if n < sub.pressured && conns > 1 {
+			// NSQ can't lower the RDY of several connections, they're reset first.
+			sub.q.ChangeMaxInFlight(0)
+		}
+		sub.q.ChangeMaxInFlight(n)
+		sub.pressured = n
+	}
+}
@@ -0,0 +1,113 @@
+package nsq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang-queue/queue/core"
+)
+
+// BatchFunc handles the jobs of a batch together
+type BatchFunc func(context.Context, []core.QueuedMessage) error
+
+// batcher collects the jobs of the concurrent Run calls into batches,
+// every Run waits for the result of the batch of its job.
+type batcher struct {
+	size     int
+	interval time.Duration
+	fn       BatchFunc
+	// ctx returns the context the batch func is called with
+	ctx  func() (context.Context, context.CancelFunc)
+	stop <-chan struct{}
+
+	mu      sync.Mutex
+	current *batch
+}
+
+// batch is a group of jobs handed over to the batch func once it's flushed
+type batch struct {
+	// jobs are nil once their context is done before the flush
+	jobs  []core.QueuedMessage
+	size  int
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+// add the job to the current batch and return the error of the batch func once it's flushed,
+// a batch is flushed once it's full or the flush interval elapsed since its first job. The job
+// leaves the batch when ctx is done before the flush.
+func (b *batcher) add(ctx context.Context, task core.QueuedMessage) error {
+	b.mu.Lock()
+	bt := b.current
+	if bt == nil {
+		bt = &batch{done: make(chan struct{})}
+		bt.timer = time.AfterFunc(b.interval, func() {
+			b.flush(bt)
+		})
+		b.current = bt
+	}
+	i := len(bt.jobs)
+	bt.jobs = append(bt.jobs, task)
+	bt.size++
+	full := bt.size >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.flush(bt)
+	}
+
+	select {
+	case <-bt.done:
+		return bt.err
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	if b.current != bt {
+		// the batch func is running with the job already.
+		b.mu.Unlock()
+		<-bt.done
+		return bt.err
+	}
+	bt.jobs[i] = nil
+	if bt.size--; bt.size == 0 {
+		bt.timer.Stop()
+		b.current = nil
+	}
+	b.mu.Unlock()
+
+	return ctx.Err()
+}
+
+func (b *batcher) flush(bt *batch) {
+	b.mu.Lock()
+	if b.current != bt {
+		// flushed already
+		b.mu.Unlock()
+		return
+	}
+	b.current = nil
+	bt.timer.Stop()
+	jobs := make([]core.QueuedMessage, 0, bt.size)
+	for _, task := range bt.jobs {
+		if task != nil {
+			jobs = append(jobs, task)
+		}
+	}
+	b.mu.Unlock()
+
+	bt.err = b.run(jobs)
+	close(bt.done)
+}
+
+// run executes the batch func like the run func of a job
+func (b *batcher) run(jobs []core.QueuedMessage) error {
+	ctx, cancel := b.ctx()
+	defer cancel()
+
+	return execute(ctx, func(ctx context.Context, _ core.QueuedMessage) error {
+		return b.fn(ctx, jobs)
+	}, nil, b.stop)
+}
@@ -0,0 +1,145 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/golang-queue/queue/core"
+	"github.com/golang-queue/queue/job"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes the jobs published to NSQ and decodes the consumed messages
+type Codec interface {
+	Marshal(*job.Message) ([]byte, error)
+	Unmarshal([]byte, *job.Message) error
+}
+
+// jsonCodec is the default codec, matching the encoding used by the queue
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(m *job.Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m *job.Message) error {
+	return json.Unmarshal(data, m)
+}
+
+// ErrEmptyBody is returned when a job is encoded to an empty body, which nsqd can't publish
+var ErrEmptyBody = errors.New("empty message body")
+
+// ProtoCodec encodes the jobs as the protobuf message of their payload, for the services
+// publishing protobuf instead of the JSON of the queue. The timeout and retries of the jobs
+// aren't carried. New returns an empty message of the job type, the bodies which aren't one
+// are rejected and the decoded message is passed to the run func, see ProtoFromContext.
+//
+//	w, err := nsq.NewWorker(
+//		nsq.WithTopic("orders"),
+//		nsq.WithCodec(nsq.ProtoCodec{New: func() proto.Message { return &pb.Order{} }}),
+//		nsq.WithRunFunc(func(ctx context.Context, m queue.QueuedMessage) error {
+//			return process(ctx, nsq.ProtoFromContext(ctx).(*pb.Order))
+//		}),
+//	)
+//	...
+//	j, err := nsq.NewProtoJob(&pb.Order{Id: 1})
+//	...
+//	err = q.Queue(j)
+type ProtoCodec struct {
+	New func() proto.Message
+}
+
+func (c ProtoCodec) Marshal(m *job.Message) ([]byte, error) {
+	if err := c.check(m.Payload); err != nil {
+		return nil, err
+	}
+	return m.Payload, nil
+}
+
+func (c ProtoCodec) Unmarshal(data []byte, m *job.Message) error {
+	_, err := c.decode(data, m)
+	return err
+}
+
+// decode sets the payload of m to data and returns data decoded as a message of the job type,
+// nil without New
+func (c ProtoCodec) decode(data []byte, m *job.Message) (proto.Message, error) {
+	var pm proto.Message
+	if c.New != nil {
+		pm = c.New()
+		if err := proto.Unmarshal(data, pm); err != nil {
+			return nil, err
+		}
+	}
+	m.Payload = data
+	return pm, nil
+}
+
+// check verifies that data is a message of the job type
+func (c ProtoCodec) check(data []byte) error {
+	if c.New == nil {
+		return nil
+	}
+	return proto.Unmarshal(data, c.New())
+}
+
+// protoMessageKey is the context key of the message decoded by ProtoCodec
+type protoMessageKey struct{}
+
+// ProtoFromContext returns the protobuf message of the job decoded by ProtoCodec,
+// from the context passed to the run func. It's nil if the codec has no New func.
+func ProtoFromContext(ctx context.Context) proto.Message {
+	m, _ := ctx.Value(protoMessageKey{}).(proto.Message)
+	return m
+}
+
+// ProtoJob is a protobuf message queued as a job, see ProtoCodec and NewProtoJob
+type ProtoJob struct {
+	proto.Message
+	body []byte
+}
+
+// NewProtoJob marshals m to be queued as a job
+func NewProtoJob(m proto.Message) (ProtoJob, error) {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return ProtoJob{}, err
+	}
+	return ProtoJob{Message: m, body: b}, nil
+}
+
+// Bytes returns the protobuf encoding of the message
+func (j ProtoJob) Bytes() []byte {
+	return j.body
+}
+
+// encode converts the job handed over by the queue to the NSQ message body
+func (w *Worker) encode(task core.QueuedMessage) ([]byte, error) {
+	// the queue has already encoded the job as JSON
+	if _, ok := w.opts.codec.(jsonCodec); ok {
+		return task.Bytes(), nil
+	}
+
+	var m job.Message
+	if err := json.Unmarshal(task.Bytes(), &m); err != nil {
+		return nil, err
+	}
+
+	body, err := w.opts.codec.Marshal(&m)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, ErrEmptyBody
+	}
+	return body, nil
+}
+
+// decode decodes the body of a consumed message, returning the protobuf message decoded by ProtoCodec
+func (w *Worker) decode(body []byte, m *job.Message) (proto.Message, error) {
+	if c, ok := w.opts.codec.(ProtoCodec); ok {
+		return c.decode(body, m)
+	}
+	return nil, w.opts.codec.Unmarshal(body, m)
+}
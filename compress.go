@@ -0,0 +1,45 @@
+package nsq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// compressedPrefix starts the bodies compressed by WithPayloadCompression,
+// the JSON and gob bodies never start with a zero byte.
+var compressedPrefix = []byte("\x00gzip\x00")
+
+// compress gzips the bodies larger than the compression threshold
+func (w *Worker) compress(body []byte) ([]byte, error) {
+	if w.opts.compressionThreshold <= 0 || len(body) <= w.opts.compressionThreshold {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(compressedPrefix)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompress returns the body compressed by compress, other bodies are returned as is
+func decompress(body []byte) ([]byte, error) {
+	if !bytes.HasPrefix(body, compressedPrefix) {
+		return body, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body[len(compressedPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,166 @@
+package nsq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connPollInterval is how often the consumer connections are checked for the connection listener,
+// the max in flight per connection, the topic priorities and the backpressure
+const connPollInterval = 100 * time.Millisecond
+
+// ConnEventType is the kind of a ConnEvent
+type ConnEventType int
+
+const (
+	// ConnConnected is sent once a consumer opened a connection to nsqd
+	ConnConnected ConnEventType = iota
+	// ConnDisconnected is sent once a connection of a consumer was closed
+	ConnDisconnected
+	// ConnError is sent when a consumer could not connect nsqd or nsqlookupd
+	ConnError
+)
+
+func (t ConnEventType) String() string {
+	switch t {
+	case ConnConnected:
+		return "connected"
+	case ConnDisconnected:
+		return "disconnected"
+	case ConnError:
+		return "error"
+	}
+
+	return "unknown"
+}
+
+// ConnEvent is a change of the connections of the consumer of a topic
+type ConnEvent struct {
+	Type    ConnEventType
+	Topic   string
+	Channel string
+	// Connections is the number of connections of the consumer after a change
+	Connections int
+	// Err is the connection error of a ConnError
+	Err error
+}
+
+// watchConns reports the changes of the consumer connections, prioritizes the topics and applies the backpressure
+// until stop is closed, NSQ doesn't expose the connection callbacks so the connections are polled.
+func (w *Worker) watchConns(stop <-chan struct{}) {
+	defer w.connWG.Done()
+
+	ticker := time.NewTicker(connPollInterval)
+	defer ticker.Stop()
+
+	for {
+		w.checkConns()
+		w.prioritize()
+		w.backpressure()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// checkConns reports the connections opened or closed since the last check
+func (w *Worker) checkConns() {
+	for _, sub := range w.subs {
+		n := sub.q.Stats().Connections
+		if n != sub.conns {
+			w.rebalance(sub, n)
+		}
+		for sub.conns < n {
+			sub.conns++
+			w.notifyConn(ConnEvent{Type: ConnConnected, Topic: sub.topic, Channel: sub.channel, Connections: sub.conns})
+		}
+		for sub.conns > n {
+			sub.conns--
+			w.notifyConn(ConnEvent{Type: ConnDisconnected, Topic: sub.topic, Channel: sub.channel, Connections: sub.conns})
+		}
+	}
+}
+
+// rebalance changes the max in flight of the consumer of sub to its n connections,
+// so NSQ which divides it between the connections sends each at most the max per connection.
+func (w *Worker) rebalance(sub *subscription, n int) {
+	if w.opts.maxInFlightPerConn == 0 || atomic.LoadInt32(&w.stopFlag) == 1 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if atomic.LoadInt32(&w.paused) == 0 {
+		sub.q.ChangeMaxInFlight(w.maxInFlight(sub, n))
+	}
+}
+
+func (w *Worker) notifyConn(event ConnEvent) {
+	if w.opts.connListener != nil {
+		w.opts.connListener(event)
+	}
+}
+
+// superviseConns reconnects the consumers missing a connection to one of the nsqd
+// addresses until stop is closed or the reconnect attempts are exhausted.
+func (w *Worker) superviseConns(stop <-chan struct{}) {
+	defer w.connWG.Done()
+
+	addrs := len(w.opts.nsqdAddrs)
+	if addrs == 0 {
+		addrs = 1
+	}
+
+	ticker := time.NewTicker(connPollInterval)
+	defer ticker.Stop()
+
+	gaveUp := make(map[*subscription]bool)
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-w.stop:
+			return
+		}
+
+		for _, sub := range w.subs {
+			if gaveUp[sub] || sub.q.Stats().Connections >= addrs {
+				continue
+			}
+			if err := w.reconnect(sub); err != nil {
+				w.opts.logger.Errorf("could not reconnect topic %s channel %s to nsqd, giving up: %s",
+					sub.topic, sub.channel, err)
+				gaveUp[sub] = true
+			}
+		}
+	}
+}
+
+// reconnect connects the consumer of sub to the nsqd addresses it's not connected to,
+// the delay between the attempts doubles up to the max delay.
+func (w *Worker) reconnect(sub *subscription) (err error) {
+	delay := w.opts.reconnectDelay
+	for i := 0; i < w.opts.reconnectAttempts; i++ {
+		select {
+		case <-time.After(delay):
+		case <-w.stop:
+			return nil
+		}
+
+		if err = w.connect(sub.q); err == nil {
+			return nil
+		}
+
+		if delay *= 2; delay > w.opts.reconnectMaxDelay {
+			delay = w.opts.reconnectMaxDelay
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,97 @@
+package nsq
+
+import (
+	"sync"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// DedupeStore records the IDs of the messages handled successfully, the worker
+// finishes the messages it has seen already without running their job.
+type DedupeStore interface {
+	// Seen reports whether id has been recorded and hasn't expired yet
+	Seen(id string) (bool, error)
+	// Record id until ttl elapsed
+	Record(id string, ttl time.Duration) error
+}
+
+// MemoryDedupeStore is a DedupeStore keeping the IDs in memory, for the workers of a single process
+type MemoryDedupeStore struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+	// now is replaced by the tests
+	now func() time.Time
+}
+
+// NewMemoryDedupeStore returns an empty MemoryDedupeStore
+func NewMemoryDedupeStore() *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		expires: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// Seen implements DedupeStore
+func (s *MemoryDedupeStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.expires[id]
+	if !ok {
+		return false, nil
+	}
+	if !s.now().Before(expires) {
+		delete(s.expires, id)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Record implements DedupeStore, the expired IDs are removed once per ttl
+func (s *MemoryDedupeStore) Record(id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= ttl {
+		for id, expires := range s.expires {
+			if !now.Before(expires) {
+				delete(s.expires, id)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.expires[id] = now.Add(ttl)
+
+	return nil
+}
+
+// duplicate reports whether msg has been handled already, a store error
+// is logged and the message handled again.
+func (w *Worker) duplicate(msg *nsq.Message) bool {
+	if w.opts.dedupeStore == nil {
+		return false
+	}
+
+	seen, err := w.opts.dedupeStore.Seen(string(msg.ID[:]))
+	if err != nil {
+		w.opts.logger.Errorf("could not check message %s in the dedupe store: %s", msg.ID, err)
+		return false
+	}
+
+	return seen
+}
+
+// recordHandled records msg in the dedupe store once its job succeeded
+func (w *Worker) recordHandled(msg *nsq.Message) {
+	if w.opts.dedupeStore == nil {
+		return
+	}
+
+	if err := w.opts.dedupeStore.Record(string(msg.ID[:]), w.opts.dedupeTTL); err != nil {
+		w.opts.logger.Errorf("could not record message %s in the dedupe store: %s", msg.ID, err)
+	}
+}
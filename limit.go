@@ -0,0 +1,35 @@
+package nsq
+
+import (
+	"context"
+
+	"github.com/golang-queue/queue/core"
+	"golang.org/x/time/rate"
+)
+
+// limitConcurrency runs run once a slot of sem is free, the jobs waiting for a slot
+// stay in flight and give up once their context is done.
+func limitConcurrency(sem chan struct{}, run RunFunc) RunFunc {
+	return func(ctx context.Context, m core.QueuedMessage) error {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-sem }()
+
+		return run(ctx, m)
+	}
+}
+
+// limitRate runs run once the limiter allows it, the jobs waiting for the limiter
+// give up once their context is done.
+func limitRate(l *rate.Limiter, run RunFunc) RunFunc {
+	return func(ctx context.Context, m core.QueuedMessage) error {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+
+		return run(ctx, m)
+	}
+}
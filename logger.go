@@ -0,0 +1,56 @@
+package nsq
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang-queue/queue"
+)
+
+// nsqLogger writes the internal logs of the NSQ consumer and producer to the queue logger
+type nsqLogger struct {
+	logger queue.Logger
+}
+
+// Output implements the nsq.Logger interface, the lines are prefixed with their level.
+// The queue logger has no warning level, the warnings are logged as info since NSQ warns
+// on every graceful shutdown.
+func (l nsqLogger) Output(_ int, s string) error {
+	if strings.HasPrefix(s, "ERR") {
+		l.logger.Error(s)
+	} else {
+		l.logger.Info(s)
+	}
+
+	return nil
+}
+
+// namedLogger prefixes the lines of the worker set by WithName with its name
+type namedLogger struct {
+	name   string
+	logger queue.Logger
+}
+
+func (l namedLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof("[%s] %s", l.name, fmt.Sprintf(format, args...))
+}
+
+func (l namedLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf("[%s] %s", l.name, fmt.Sprintf(format, args...))
+}
+
+func (l namedLogger) Fatalf(format string, args ...interface{}) {
+	l.logger.Fatalf("[%s] %s", l.name, fmt.Sprintf(format, args...))
+}
+
+func (l namedLogger) Info(args ...interface{}) {
+	l.logger.Info("[" + l.name + "] " + fmt.Sprint(args...))
+}
+
+func (l namedLogger) Error(args ...interface{}) {
+	l.logger.Error("[" + l.name + "] " + fmt.Sprint(args...))
+}
+
+func (l namedLogger) Fatal(args ...interface{}) {
+	l.logger.Fatal("[" + l.name + "] " + fmt.Sprint(args...))
+}
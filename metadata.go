@@ -0,0 +1,96 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golang-queue/queue/job"
+	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// envelope is the JSON body of a job with its metadata and trace context,
+// consumers which don't know about them simply ignore the extra fields.
+type envelope struct {
+	job.Message
+	Trace    map[string]string `json:"trace,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// extras of an envelope, without the job
+type extras struct {
+	Trace    map[string]string `json:"trace"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type (
+	metadataKey    struct{}
+	messageInfoKey struct{}
+)
+
+// MessageInfo describes the NSQ message of a job
+type MessageInfo struct {
+	ID        nsq.MessageID
+	Timestamp time.Time
+	Attempts  uint16
+}
+
+// MessageInfoFromContext returns the NSQ message of the job,
+// from the context passed to the run func
+func MessageInfoFromContext(ctx context.Context) (MessageInfo, bool) {
+	info, ok := ctx.Value(messageInfoKey{}).(MessageInfo)
+	return info, ok
+}
+
+// MetadataFromContext returns the metadata given to QueueWithMetadata,
+// from the context passed to the run func
+func MetadataFromContext(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return md
+}
+
+// wrap adds the trace context of ctx and the metadata to the body
+func (w *Worker) wrap(ctx context.Context, body []byte, md map[string]string) ([]byte, error) {
+	var trace map[string]string
+	if w.tracer != nil {
+		carrier := propagation.MapCarrier{}
+		propagator.Inject(ctx, carrier)
+		trace = carrier
+	}
+
+	if len(trace) == 0 && len(md) == 0 {
+		return body, nil
+	}
+
+	if _, ok := w.opts.codec.(jsonCodec); !ok {
+		if len(md) > 0 {
+			return nil, errors.New("metadata is only supported by the JSON codec")
+		}
+		return body, nil
+	}
+
+	var e envelope
+	if err := json.Unmarshal(body, &e.Message); err != nil {
+		return nil, err
+	}
+	e.Trace = trace
+	e.Metadata = md
+
+	return json.Marshal(e)
+}
+
+// unwrap returns the extras carried by msg
+func (w *Worker) unwrap(msg *nsq.Message) extras {
+	var e extras
+	if msg == nil {
+		return e
+	}
+
+	if _, ok := w.opts.codec.(jsonCodec); ok {
+		_ = json.Unmarshal(msg.Body, &e)
+	}
+
+	return e
+}
@@ -0,0 +1,138 @@
+package nsq
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics of the jobs handled by the worker, a nil metrics records nothing
+type metrics struct {
+	processed prometheus.Counter
+	failed    prometheus.Counter
+	panicked  prometheus.Counter
+	requeued  prometheus.Counter
+	duration  prometheus.Observer
+}
+
+func newMetrics(reg prometheus.Registerer, topic, channel string) (*metrics, error) {
+	labels := []string{"topic", "channel"}
+	processed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nsq",
+		Subsystem: "worker",
+		Name:      "jobs_processed_total",
+		Help:      "Number of jobs processed successfully.",
+	}, labels)
+	failed := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nsq",
+		Subsystem: "worker",
+		Name:      "jobs_failed_total",
+		Help:      "Number of jobs which returned an error.",
+	}, labels)
+	panicked := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nsq",
+		Subsystem: "worker",
+		Name:      "jobs_panicked_total",
+		Help:      "Number of jobs which panicked.",
+	}, labels)
+	requeued := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nsq",
+		Subsystem: "worker",
+		Name:      "jobs_requeued_total",
+		Help:      "Number of messages requeued to nsqd.",
+	}, labels)
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nsq",
+		Subsystem: "worker",
+		Name:      "job_duration_seconds",
+		Help:      "Duration of the jobs in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels)
+
+	// workers sharing a registerer share the collectors
+	var err error
+	if processed, err = registerVec(reg, processed); err != nil {
+		return nil, err
+	}
+	if failed, err = registerVec(reg, failed); err != nil {
+		return nil, err
+	}
+	if panicked, err = registerVec(reg, panicked); err != nil {
+		return nil, err
+	}
+	if requeued, err = registerVec(reg, requeued); err != nil {
+		return nil, err
+	}
+	if err = reg.Register(duration); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		duration = are.ExistingCollector.(*prometheus.HistogramVec)
+	}
+
+	return &metrics{
+		processed: processed.WithLabelValues(topic, channel),
+		failed:    failed.WithLabelValues(topic, channel),
+		panicked:  panicked.WithLabelValues(topic, channel),
+		requeued:  requeued.WithLabelValues(topic, channel),
+		duration:  duration.WithLabelValues(topic, channel),
+	}, nil
+}
+
+func registerVec(reg prometheus.Registerer, c *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	if err := reg.Register(c); err != nil {
+		are := prometheus.AlreadyRegisteredError{}
+		if !errors.As(err, &are) {
+			return nil, err
+		}
+		return are.ExistingCollector.(*prometheus.CounterVec), nil
+	}
+
+	return c, nil
+}
+
+func (m *metrics) observe(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.duration.Observe(d.Seconds())
+	if err != nil {
+		m.failed.Inc()
+		return
+	}
+	m.processed.Inc()
+}
+
+func (m *metrics) incPanicked() {
+	if m == nil {
+		return
+	}
+
+	m.panicked.Inc()
+}
+
+func (m *metrics) incRequeued() {
+	if m == nil {
+		return
+	}
+
+	m.requeued.Inc()
+}
+
+// registerMetrics adds the metrics of the subscriptions to the registerer
+func registerMetrics(subs []*subscription, registerer prometheus.Registerer) (err error) {
+	if registerer == nil {
+		return nil
+	}
+
+	for _, sub := range subs {
+		if sub.metrics, err = newMetrics(registerer, sub.topic, sub.channel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
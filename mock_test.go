@@ -0,0 +1,463 @@
+package nsq
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// mockNSQD speaks just enough of the nsqd TCP protocol for a consumer
+// to IDENTIFY, SUB and CLS against it. Messages passed to deliver are sent
+// to the subscribed clients, the ones passed to deliverTopic to the clients
+// of the topic, and the commands received are recorded.
+type mockNSQD struct {
+	t        *testing.T
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	got      []string
+	msgs     chan *nsq.Message
+	topics   map[string]chan *nsq.Message
+	rdys     map[string]string
+	bodies   [][]byte
+}
+
+func newMockNSQD(t *testing.T, addr string) *mockNSQD {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("mock nsqd: listen failed - %s", err)
+	}
+
+	n := &mockNSQD{
+		t:        t,
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+		msgs:     make(chan *nsq.Message, 16),
+		topics:   make(map[string]chan *nsq.Message),
+		rdys:     make(map[string]string),
+	}
+
+	n.wg.Add(1)
+	go n.listen()
+	t.Cleanup(n.Close)
+
+	return n
+}
+
+// Addr returns the TCP address of the mock.
+func (n *mockNSQD) Addr() string {
+	return n.listener.Addr().String()
+}
+
+// Close stops accepting and drops every client connection.
+func (n *mockNSQD) Close() {
+	_ = n.listener.Close()
+	n.mu.Lock()
+	for conn := range n.conns {
+		_ = conn.Close()
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+}
+
+// deliver sends a message with the given attempts to a subscribed client.
+func (n *mockNSQD) deliver(id string, body []byte, attempts uint16) {
+	var msgID nsq.MessageID
+	copy(msgID[:], id)
+	msg := nsq.NewMessage(msgID, body)
+	msg.Attempts = attempts
+	n.msgs <- msg
+}
+
+// deliverTopic sends a message with the given attempts to a client of the topic.
+func (n *mockNSQD) deliverTopic(topic, id string, body []byte, attempts uint16) {
+	var msgID nsq.MessageID
+	copy(msgID[:], id)
+	msg := nsq.NewMessage(msgID, body)
+	msg.Attempts = attempts
+	n.topicMsgs(topic) <- msg
+}
+
+func (n *mockNSQD) topicMsgs(topic string) chan *nsq.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	msgs, ok := n.topics[topic]
+	if !ok {
+		msgs = make(chan *nsq.Message, 16)
+		n.topics[topic] = msgs
+	}
+	return msgs
+}
+
+// published returns the bodies of the PUB commands received.
+func (n *mockNSQD) published() [][]byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([][]byte(nil), n.bodies...)
+}
+
+// lastRDY returns the last RDY command received from a client of the topic.
+func (n *mockNSQD) lastRDY(topic string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rdys[topic]
+}
+
+// count returns how many commands with the given name were received.
+func (n *mockNSQD) count(cmd string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	c := 0
+	for _, got := range n.got {
+		if strings.HasPrefix(got, cmd+" ") || got == cmd {
+			c++
+		}
+	}
+	return c
+}
+
+// last returns the last command with the given name which was received.
+func (n *mockNSQD) last(cmd string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i := len(n.got) - 1; i >= 0; i-- {
+		if strings.HasPrefix(n.got[i], cmd+" ") || n.got[i] == cmd {
+			return n.got[i]
+		}
+	}
+	return ""
+}
+
+func (n *mockNSQD) listen() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		n.conns[conn] = struct{}{}
+		n.mu.Unlock()
+
+		n.wg.Add(1)
+		go n.handle(conn)
+	}
+}
+
+func (n *mockNSQD) handle(conn net.Conn) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		n.mu.Lock()
+		delete(n.conns, conn)
+		n.mu.Unlock()
+		_ = conn.Close()
+		n.wg.Done()
+	}()
+
+	var wmu sync.Mutex
+	write := func(frameType int32, data []byte) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		writeMockFrame(conn, frameType, data)
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return
+	}
+
+	var ready sync.Once
+	var topic string
+	rdr := bufio.NewReader(conn)
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		line = bytes.TrimSpace(line)
+		n.mu.Lock()
+		n.got = append(n.got, string(line))
+		n.mu.Unlock()
+		params := bytes.Split(line, []byte(" "))
+
+		switch string(params[0]) {
+		case "IDENTIFY", "PUB":
+			body, err := readMockBody(rdr)
+			if err != nil {
+				return
+			}
+			if string(params[0]) == "PUB" {
+				n.mu.Lock()
+				n.bodies = append(n.bodies, body)
+				n.mu.Unlock()
+			}
+			write(nsq.FrameTypeResponse, []byte("OK"))
+		case "SUB":
+			topic = string(params[1])
+			write(nsq.FrameTypeResponse, []byte("OK"))
+		case "RDY":
+			n.mu.Lock()
+			n.rdys[topic] = string(line)
+			n.mu.Unlock()
+			if string(params[1]) == "0" {
+				continue
+			}
+			ready.Do(func() {
+				n.wg.Add(1)
+				topicMsgs := n.topicMsgs(topic)
+				go func() {
+					defer n.wg.Done()
+					for {
+						var msg *nsq.Message
+						select {
+						case msg = <-n.msgs:
+						case msg = <-topicMsgs:
+						case <-done:
+							return
+						}
+						var buf bytes.Buffer
+						_, _ = msg.WriteTo(&buf)
+						write(nsq.FrameTypeMessage, buf.Bytes())
+					}
+				}()
+			})
+		case "CLS":
+			write(nsq.FrameTypeResponse, []byte("CLOSE_WAIT"))
+		}
+	}
+}
+
+func readMockBody(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size))
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func writeMockFrame(w io.Writer, frameType int32, data []byte) {
+	buf := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)+4))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(frameType))
+	_, _ = w.Write(append(buf, data...))
+}
+
+// newStalledNSQD returns the address of a listener which accepts the
+// connections and never answers, like an unresponsive nsqd.
+func newStalledNSQD(t *testing.T) string {
+	l, err := net.Listen("tcp", host+":0")
+	if err != nil {
+		t.Fatalf("stalled nsqd: listen failed - %s", err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = l.Close()
+		<-done
+		mu.Lock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		mu.Unlock()
+	})
+
+	return l.Addr().String()
+}
+
+// writeTestCerts generates a CA and a client certificate signed by it, and returns
+// the files of the client certificate, its key and the CA.
+func writeTestCerts(t *testing.T) (certFile, keyFile, caFile string) {
+	dir := t.TempDir()
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+			t.Fatalf("test certs: write %s failed - %s", name, err)
+		}
+		return path
+	}
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("test certs: generate key failed - %s", err)
+		}
+		return key
+	}
+
+	caKey := newKey()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("test certs: create ca failed - %s", err)
+	}
+
+	key := newKey()
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("test certs: create certificate failed - %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("test certs: marshal key failed - %s", err)
+	}
+
+	return write("client.pem", "CERTIFICATE", certDER), write("client-key.pem", "EC PRIVATE KEY", keyDER),
+		write("ca.pem", "CERTIFICATE", caDER)
+}
+
+// mockDelegate records the responses sent for a message.
+type mockDelegate struct {
+	mu       sync.Mutex
+	finishes int
+	requeues []time.Duration
+	touches  int
+}
+
+func newMockMessage(body []byte) (*nsq.Message, *mockDelegate) {
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+	d := &mockDelegate{}
+	msg := nsq.NewMessage(id, body)
+	msg.Delegate = d
+	msg.Attempts = 1
+
+	return msg, d
+}
+
+func (d *mockDelegate) OnFinish(*nsq.Message) {
+	d.mu.Lock()
+	d.finishes++
+	d.mu.Unlock()
+}
+
+func (d *mockDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.mu.Lock()
+	d.requeues = append(d.requeues, delay)
+	d.mu.Unlock()
+}
+
+func (d *mockDelegate) OnTouch(*nsq.Message) {
+	d.mu.Lock()
+	d.touches++
+	d.mu.Unlock()
+}
+
+func (d *mockDelegate) finished() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.finishes
+}
+
+func (d *mockDelegate) requeued() []time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]time.Duration(nil), d.requeues...)
+}
+
+func (d *mockDelegate) touched() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.touches
+}
+
+// mockLogger records the logged infos and errors.
+type mockLogger struct {
+	mu     sync.Mutex
+	infos  []string
+	errors []string
+}
+
+func (l *mockLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *mockLogger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *mockLogger) Fatalf(format string, args ...interface{}) {}
+
+func (l *mockLogger) Info(args ...interface{}) {
+	l.mu.Lock()
+	l.infos = append(l.infos, fmt.Sprint(args...))
+	l.mu.Unlock()
+}
+
+func (l *mockLogger) Error(args ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprint(args...))
+	l.mu.Unlock()
+}
+
+func (l *mockLogger) Fatal(args ...interface{}) {}
+
+func (l *mockLogger) logged() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors...)
+}
+
+func (l *mockLogger) informed() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.infos...)
+}
@@ -2,7 +2,13 @@ package nsq
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"sync/atomic" //nolint:typecheck,nolintlint
 	"time"
@@ -12,130 +18,1463 @@ import (
 	"github.com/golang-queue/queue/job"
 
 	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
 )
 
 var _ core.Worker = (*Worker)(nil)
 
+// nameRules describes the topic and channel names accepted by NSQ
+const nameRules = "names must be 1 to 64 characters of [.a-zA-Z0-9_-] with an optional #ephemeral suffix"
+
+const (
+	// defaultChannel is used when no channel is given by WithChannel
+	defaultChannel = "ch"
+	// ephemeralSuffix is added to the channel by WithEphemeralChannel
+	ephemeralSuffix = "#ephemeral"
+)
+
+var (
+	// ErrProducerNotConfigured is returned when publishing with a consumer only worker
+	ErrProducerNotConfigured = errors.New("producer not configured")
+	// ErrConsumerNotConfigured is returned when requesting from a producer only worker
+	ErrConsumerNotConfigured = errors.New("consumer not configured")
+	// ErrConsumerNotStarted is returned when changing a consumer not started by Request yet
+	ErrConsumerNotStarted = errors.New("consumer not started")
+	// ErrDrop can be returned by the run func to finish the message instead of
+	// requeueing it, e.g. for a payload which will never be processed
+	ErrDrop = errors.New("drop message")
+)
+
+// RequeueError can be returned by the run func to requeue the message
+// after Delay instead of the default backoff of NSQ.
+type RequeueError struct {
+	Delay time.Duration
+}
+
+func (e RequeueError) Error() string {
+	return fmt.Sprintf("requeue message in %s", e.Delay)
+}
+
+// PanicError is returned by Run when the run func panicked
+type PanicError struct {
+	Value interface{}
+	// Stack is the stack trace captured where the panic was recovered
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
 // Worker for NSQ
 type Worker struct {
-	q         *nsq.Consumer
-	p         *nsq.Producer
-	cfg       *nsq.Config
-	stopOnce  sync.Once
-	startOnce sync.Once
-	stop      chan struct{}
-	stopFlag  int32
-	opts      Options
-	tasks     chan *nsq.Message
+	// busyWorkers, publishing and the counters are accessed atomically, keep them 64-bit aligned
+	busyWorkers uint64
+	publishing  int64        // counts the publishes not acknowledged by nsqd yet
+	requeued    uint64       // counts the messages requeued for a failed job
+	processed   uint64       // counts the jobs which succeeded
+	failed      uint64       // counts the jobs which returned an error or panicked
+	mu          sync.RWMutex // guards the consumers of subs, cfg and opts.maxInFlight
+	subs        []*subscription
+	p           *nsq.Producer
+	cfg         *nsq.Config
+	stopOnce    sync.Once
+	startOnce   sync.Once
+	stop        chan struct{}
+	stopFlag    int32
+	paused      int32
+	opts        Options
+	tasks       chan *delivery
+	// inflight maps the jobs handed to the queue to their deliveries
+	inflight sync.Map
+	// published receives the results of QueueAsync
+	published   chan *nsq.ProducerTransaction
+	publishDone chan struct{}
+	publishOnce sync.Once
+	publishWG   sync.WaitGroup
+	connWG      sync.WaitGroup
+	tracer      trace.Tracer
+	rand        *rand.Rand // draws the startup jitter while starting the consumer
+
+	// restartMu serializes Restart and the stop of the consumers by shutdown
+	restartMu sync.Mutex
+	// options are the options given to NewWorker and the restarts
+	options []Option
+	// restarted drops the consumer of WithConsumer, it's made for the topic given to NewWorker
+	restarted bool
+	// connStop stops the connection watchers of the running consumers
+	connStop chan struct{}
+
+	// timeoutWarning warns once of a job timeout longer than the msg timeout
+	timeoutWarning sync.Once
+	// pendingConns maps the pendingConn of the timed out connects to their result
+	pendingConns sync.Map
+}
+
+// NewWorker for struc
+func NewWorker(opts ...Option) (*Worker, error) {
+	w := &Worker{
+		opts:        newOptions(opts...),
+		stop:        make(chan struct{}),
+		tasks:       make(chan *delivery),
+		published:   make(chan *nsq.ProducerTransaction),
+		publishDone: make(chan struct{}),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		options:     opts,
+	}
+
+	if _, _, err := net.SplitHostPort(w.opts.addr); err != nil {
+		return nil, fmt.Errorf("invalid nsqd address %q: %w", w.opts.addr, err)
+	}
+
+	if _, _, err := net.SplitHostPort(w.opts.producerAddr); err != nil {
+		return nil, fmt.Errorf("invalid producer address %q: %w", w.opts.producerAddr, err)
+	}
+
+	subs, err := w.newSubscriptions(&w.opts)
+	if err != nil {
+		return nil, err
+	}
+	// the restarts keep the default channel without reporting it again.
+	for _, th := range topicHandlers(&w.opts) {
+		if th.Channel == "" && !w.opts.producerOnly {
+			w.opts.logger.Infof("no channel set, consuming topic %s from the %q channel", th.Topic, defaultChannel)
+		}
+	}
+	w.subs = subs
+	w.opts.channel = w.subs[0].channel
+
+	if w.opts.deadLetterTopic != "" && !nsq.IsValidTopicName(w.opts.deadLetterTopic) {
+		return nil, fmt.Errorf("invalid dead letter topic name %q: %s", w.opts.deadLetterTopic, nameRules)
+	}
+
+	if w.opts.drainTopic != "" && !nsq.IsValidTopicName(w.opts.drainTopic) {
+		return nil, fmt.Errorf("invalid drain topic name %q: %s", w.opts.drainTopic, nameRules)
+	}
+
+	if w.opts.consumerOnly && w.opts.producerOnly {
+		return nil, errors.New("consumer only and producer only are mutually exclusive")
+	}
+
+	if w.opts.consumerOnly && w.opts.deadLetterTopic != "" {
+		return nil, errors.New("dead letter topic needs a producer")
+	}
+
+	if w.opts.producerOnly && w.opts.drainTopic != "" {
+		return nil, errors.New("drain topic needs a consumer")
+	}
+
+	if w.opts.consumerOnly && w.opts.drainTopic != "" {
+		return nil, errors.New("drain topic needs a producer")
+	}
+
+	if w.opts.consumerOnly && w.opts.producer != nil {
+		return nil, errors.New("consumer only worker can't use a producer")
+	}
+
+	if w.opts.producerOnly && w.opts.consumer != nil {
+		return nil, errors.New("producer only worker can't use a consumer")
+	}
+
+	cfg, err := newConfig(w.opts)
+	if err != nil {
+		return nil, err
+	}
+	w.cfg = cfg
+
+	if w.opts.tracerProvider != nil {
+		w.tracer = w.opts.tracerProvider.Tracer(tracerName)
+	}
+
+	if err = registerMetrics(w.subs, w.opts.registerer); err != nil {
+		return nil, err
+	}
+
+	if !w.opts.consumerOnly {
+		if err = w.startProducer(); err != nil {
+			return nil, err
+		}
+		if err = w.createTopics(); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+// newSubscriptions builds the subscriptions of the topics consumed with o and wraps their run funcs
+func (w *Worker) newSubscriptions(o *Options) ([]*subscription, error) {
+	var subs []*subscription
+	if o.topic == "" {
+		return nil, errors.New("topic is required")
+	}
+
+	if o.producerOnly && (len(o.topics) > 0 || len(o.topicHandlers) > 0) {
+		return nil, errors.New("topics need a consumer")
+	}
+
+	topics := topicHandlers(o)
+
+	run := RunFunc(o.runFunc)
+	if o.batchFunc != nil {
+		b := &batcher{
+			size:     o.batchSize,
+			interval: o.batchInterval,
+			fn:       o.batchFunc,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return w.jobContext(context.Background())
+			},
+			stop: w.stop,
+		}
+		run = o.chain(b.add)
+	}
+
+	for _, th := range topics {
+		sub, err := w.newSubscription(o, th.TopicChannel)
+		if err != nil {
+			return nil, err
+		}
+		sub.run = th.run
+		if sub.run == nil {
+			sub.run = run
+		}
+		for _, s := range subs {
+			if s.topic == sub.topic && s.channel == sub.channel {
+				return nil, fmt.Errorf("topic %s is consumed twice from channel %s", sub.topic, sub.channel)
+			}
+		}
+		subs = append(subs, sub)
+	}
+
+	if o.concurrencyLimit > 0 {
+		// the topics share the limit
+		sem := make(chan struct{}, o.concurrencyLimit)
+		for _, sub := range subs {
+			sub.run = limitConcurrency(sem, sub.run)
+		}
+	}
+
+	if o.rateLimit > 0 {
+		// wait for the limiter before taking a slot of the concurrency limit.
+		l := rate.NewLimiter(rate.Limit(o.rateLimit), o.rateBurst)
+		for _, sub := range subs {
+			sub.run = limitRate(l, sub.run)
+		}
+	}
+
+	limiters := make(map[string]*rate.Limiter)
+	for _, sub := range subs {
+		r, ok := o.topicRateLimits[sub.topic]
+		if !ok {
+			continue
+		}
+		// the channels of a topic share its limit, it's waited for before the worker limit.
+		l := limiters[sub.topic]
+		if l == nil {
+			l = rate.NewLimiter(rate.Limit(r.rps), r.burst)
+			limiters[sub.topic] = l
+		}
+		sub.run = limitRate(l, sub.run)
+	}
+	for topic := range o.topicRateLimits {
+		if limiters[topic] == nil {
+			return nil, fmt.Errorf("rate limited topic %s is not consumed", topic)
+		}
+	}
+
+	for topic := range o.topicPriorities {
+		if !consumes(subs, topic) {
+			return nil, fmt.Errorf("prioritized topic %s is not consumed", topic)
+		}
+	}
+
+	return subs, nil
+}
+
+// topicHandlers lists the topics consumed with o, the one set by WithTopic first
+func topicHandlers(o *Options) []topicHandler {
+	topics := []topicHandler{{TopicChannel: TopicChannel{Topic: o.topic, Channel: o.channel}}}
+	for _, tc := range o.topics {
+		topics = append(topics, topicHandler{TopicChannel: tc})
+	}
+	return append(topics, o.topicHandlers...)
+}
+
+// newSubscription validates the topic and channel consumed by the worker
+func (w *Worker) newSubscription(o *Options, tc TopicChannel) (*subscription, error) {
+	if !nsq.IsValidTopicName(tc.Topic) {
+		return nil, fmt.Errorf("invalid topic name %q: %s", tc.Topic, nameRules)
+	}
+
+	channel := tc.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
+
+	if o.ephemeral && !strings.HasSuffix(channel, ephemeralSuffix) {
+		channel += ephemeralSuffix
+	}
+
+	if !nsq.IsValidChannelName(channel) {
+		return nil, fmt.Errorf("invalid channel name %q: %s", channel, nameRules)
+	}
+
+	return &subscription{topic: tc.Topic, channel: channel}, nil
+}
+
+// newConfig builds the NSQ config shared by the producer and consumer
+func newConfig(opts Options) (*nsq.Config, error) {
+	if opts.err != nil {
+		return nil, opts.err
+	}
+
+	cfg := nsq.NewConfig()
+	if opts.config != nil {
+		c := *opts.config
+		cfg = &c
+	}
+	cfg.MaxInFlight = opts.maxInFlight
+	if opts.maxInFlightPerConn > 0 && opts.maxInFlightPerConn < cfg.MaxInFlight {
+		// the consumers start with a single connection, see Worker.maxInFlight
+		cfg.MaxInFlight = opts.maxInFlightPerConn
+	}
+	cfg.AuthSecret = opts.authSecret
+	cfg.MaxAttempts = opts.maxAttempts
+	cfg.SampleRate = opts.sampleRate
+
+	if opts.clientID != "" {
+		cfg.ClientID = opts.clientID
+	}
+
+	if opts.hostname != "" {
+		cfg.Hostname = opts.hostname
+	}
+
+	if opts.userAgent != "" {
+		cfg.UserAgent = opts.userAgent
+	}
+
+	if opts.tlsConfig != nil {
+		cfg.TlsV1 = true
+		cfg.TlsConfig = opts.tlsConfig
+	}
+
+	if opts.deflate && opts.snappy {
+		return nil, errors.New("deflate and snappy compression are mutually exclusive")
+	}
+
+	if opts.deflate {
+		cfg.Deflate = true
+		cfg.DeflateLevel = opts.deflateLevel
+	}
+	if opts.snappy {
+		cfg.Snappy = true
+	}
+
+	if opts.msgTimeout > 0 {
+		cfg.MsgTimeout = opts.msgTimeout
+	}
+
+	if opts.heartbeatInterval > 0 {
+		cfg.HeartbeatInterval = opts.heartbeatInterval
+	}
+
+	if opts.lookupdPollInterval != 0 {
+		cfg.LookupdPollInterval = opts.lookupdPollInterval
+	}
+
+	if opts.lookupdPollJitter != nil {
+		cfg.LookupdPollJitter = *opts.lookupdPollJitter
+	}
+
+	if opts.lowRdyIdleTimeout != 0 {
+		cfg.LowRdyIdleTimeout = opts.lowRdyIdleTimeout
+	}
+
+	if opts.rdyRedistributeInterval != 0 {
+		cfg.RDYRedistributeInterval = opts.rdyRedistributeInterval
+	}
+
+	if opts.outputBufferSize != 0 {
+		cfg.OutputBufferSize = opts.outputBufferSize
+	}
+
+	if opts.outputBufferTimeout != 0 {
+		cfg.OutputBufferTimeout = opts.outputBufferTimeout
+	}
+
+	if opts.dialTimeout > 0 {
+		cfg.DialTimeout = opts.dialTimeout
+	}
+
+	if opts.readTimeout != 0 {
+		cfg.ReadTimeout = opts.readTimeout
+	}
+
+	if opts.writeTimeout != 0 {
+		cfg.WriteTimeout = opts.writeTimeout
+	}
+
+	if opts.maxBackoffDuration > 0 {
+		cfg.MaxBackoffDuration = opts.maxBackoffDuration
+	}
+
+	if opts.backoffMultiplier > 0 {
+		cfg.BackoffMultiplier = opts.backoffMultiplier
+	}
+
+	if opts.backoffDisabled {
+		cfg.MaxBackoffDuration = 0
+		cfg.DefaultRequeueDelay = 0
+	}
+
+	if opts.defaultRequeueDelay > 0 {
+		cfg.DefaultRequeueDelay = opts.defaultRequeueDelay
+	}
+
+	if opts.maxRequeueDelay > 0 {
+		cfg.MaxRequeueDelay = opts.maxRequeueDelay
+	}
+
+	if cfg.MsgTimeout > 0 && cfg.HeartbeatInterval >= cfg.MsgTimeout {
+		return nil, fmt.Errorf("heartbeat interval %s must be less than msg timeout %s",
+			cfg.HeartbeatInterval, cfg.MsgTimeout)
+	}
+
+	if cfg.HeartbeatInterval >= cfg.ReadTimeout {
+		return nil, fmt.Errorf("heartbeat interval %s must be less than read timeout %s",
+			cfg.HeartbeatInterval, cfg.ReadTimeout)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// validateConfig reports the configs not created by nsq.NewConfig as an error
+func validateConfig(cfg *nsq.Config) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("invalid config: %v", p)
+		}
+	}()
+
+	return cfg.Validate()
 }
 
-// NewWorker for struc
-func NewWorker(opts ...Option) *Worker {
-	w := &Worker{
-		opts:  newOptions(opts...),
-		stop:  make(chan struct{}),
-		tasks: make(chan *nsq.Message),
+func (w *Worker) startProducer() error {
+	if w.opts.producer != nil {
+		w.p = w.opts.producer
+		return nil
+	}
+
+	var err error
+
+	w.p, err = nsq.NewProducer(w.opts.producerAddr, w.cfg)
+	if err != nil {
+		return err
+	}
+
+	w.p.SetLogger(nsqLogger{logger: w.opts.logger}, w.opts.nsqLogLevel)
+
+	return nil
+}
+
+// createTopics creates the topics published by the producer when WithTopicCreate is set
+func (w *Worker) createTopics() error {
+	if w.opts.topicCreateAddr == "" {
+		return nil
+	}
+
+	topics := []string{w.opts.topic}
+	if w.opts.deadLetterTopic != "" {
+		topics = append(topics, w.opts.deadLetterTopic)
+	}
+	if w.opts.drainTopic != "" {
+		topics = append(topics, w.opts.drainTopic)
+	}
+	for _, topic := range topics {
+		if err := createTopic(w.opts.topicCreateAddr, topic); err != nil {
+			return fmt.Errorf("could not create topic %s: %w", topic, err)
+		}
+	}
+
+	return nil
+}
+
+// startupDelay returns how long the consumer waits before connecting, up to the startup jitter
+func (w *Worker) startupDelay() time.Duration {
+	if w.opts.startupJitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(w.rand.Int63n(int64(w.opts.startupJitter) + 1))
+}
+
+// createChannels creates the consumed channels before connecting when WithChannelCreate is set
+func (w *Worker) createChannels(subs []*subscription) error {
+	if w.opts.channelCreateAddr == "" {
+		return nil
+	}
+
+	for _, sub := range subs {
+		if err := createChannel(w.opts.channelCreateAddr, sub.topic, sub.channel); err != nil {
+			return fmt.Errorf("could not create channel %s of topic %s: %w", sub.channel, sub.topic, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *Worker) startConsumer() (err error) {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return queue.ErrQueueShutdown
+	}
+
+	w.startOnce.Do(func() {
+		select {
+		case <-time.After(w.startupDelay()):
+		case <-w.stop:
+			err = queue.ErrQueueShutdown
+			return
+		}
+
+		// Restart swaps the subscriptions of the consumers not started yet.
+		w.restartMu.Lock()
+		defer w.restartMu.Unlock()
+
+		q := w.opts.consumer
+		if w.restarted {
+			q = nil
+		}
+		err = w.startConsumers(w.subs, w.cfg, q)
+	})
+
+	return err
+}
+
+// startConsumers creates and connects the consumers of subs, the first one is q when it's set
+func (w *Worker) startConsumers(subs []*subscription, cfg *nsq.Config, q *nsq.Consumer) (err error) {
+	if err = w.createChannels(subs); err != nil {
+		return err
+	}
+
+	qs := make([]*nsq.Consumer, 0, len(subs))
+	for i, sub := range subs {
+		if i > 0 || q == nil {
+			q, err = nsq.NewConsumer(sub.topic, sub.channel, cfg)
+			if err != nil {
+				return err
+			}
+
+			q.SetLogger(nsqLogger{logger: w.opts.logger}, w.opts.nsqLogLevel)
+		}
+
+		if w.opts.handlers > 1 {
+			q.AddConcurrentHandlers(&messageHandler{w: w, sub: sub}, w.opts.handlers)
+		} else {
+			q.AddHandler(&messageHandler{w: w, sub: sub})
+		}
+		qs = append(qs, q)
+	}
+
+	w.mu.Lock()
+	for i, sub := range subs {
+		sub.q = qs[i]
+	}
+	w.mu.Unlock()
+
+	for _, sub := range subs {
+		if err = w.connectConsumer(sub); err != nil {
+			break
+		}
+	}
+
+	w.connStop = make(chan struct{})
+	if w.opts.connListener != nil || w.opts.maxInFlightPerConn > 0 || len(w.opts.topicPriorities) > 0 ||
+		w.opts.backpressure {
+		w.connWG.Add(1)
+		go w.watchConns(w.connStop)
+	}
+
+	if w.opts.reconnectAttempts > 0 && len(w.opts.lookupdAddrs) == 0 {
+		w.connWG.Add(1)
+		go w.superviseConns(w.connStop)
+	}
+
+	return err
+}
+
+// subscription is a topic consumed from a channel by the worker
+type subscription struct {
+	topic   string
+	channel string
+	q       *nsq.Consumer
+	run     RunFunc
+	metrics *metrics
+	// conns is the number of connections seen by the last checkConns
+	conns int
+	// throttled is set while a topic with a higher priority has messages in flight, guarded by w.mu
+	throttled bool
+	// pressured is the max in flight last set by backpressure, guarded by w.mu
+	pressured int
+}
+
+// delivery is a message received by the consumer of a subscription
+type delivery struct {
+	msg *nsq.Message
+	sub *subscription
+	// running counts the runs of the job in progress, accessed atomically
+	running int32
+	// decoded is the payload decoded by ProtoCodec
+	decoded proto.Message
+}
+
+// messageHandler hands the messages received by the consumer over to Request
+type messageHandler struct {
+	w   *Worker
+	sub *subscription
+}
+
+// HandleMessage implements nsq.Handler
+func (h *messageHandler) HandleMessage(msg *nsq.Message) error {
+	if len(msg.Body) == 0 {
+		if h.w.opts.emptyBodyHandler != nil {
+			// a non-nil error requeues the message, unless the handler responded to it.
+			return h.w.opts.emptyBodyHandler(msg)
+		}
+		// Returning nil will automatically send a FIN command to NSQ to mark the message as processed.
+		// In this case, a message with an empty body is simply ignored/discarded.
+		return nil
+	}
+
+	// the message is finished or requeued in Run once the job is done.
+	msg.DisableAutoResponse()
+
+loop:
+	for {
+		select {
+		case h.w.tasks <- &delivery{msg: msg, sub: h.sub}:
+			break loop
+		case <-h.w.stop:
+			if msg != nil {
+				// re-queue the job if worker has been shutdown.
+				msg.Requeue(-1)
+			}
+			break loop
+		case <-time.After(2 * time.Second):
+			msg.Touch()
+		}
+	}
+
+	return nil
+}
+
+// LogFailedMessage implements nsq.FailedMessageLogger, the consumer calls it
+// before dropping a message which exceeded the max attempts.
+func (h *messageHandler) LogFailedMessage(msg *nsq.Message) {
+	h.w.opts.logger.Errorf("message %s attempted %d times, giving up", msg.ID, msg.Attempts)
+	if h.w.opts.deadLetterTopic != "" {
+		if err := h.w.p.Publish(h.w.opts.deadLetterTopic, msg.Body); err != nil {
+			h.w.opts.logger.Errorf("could not publish message %s to dead letter topic %s: %s",
+				msg.ID, h.w.opts.deadLetterTopic, err)
+		}
+	}
+	if h.w.opts.deadLetterFunc != nil {
+		h.w.opts.deadLetterFunc(msg)
+	}
+}
+
+func (w *Worker) connectConsumer(sub *subscription) (err error) {
+	for i := 0; i < w.opts.connectRetryAttempts; i++ {
+		if i > 0 {
+			w.opts.logger.Errorf("could not connect nsq server, retrying in %s: %s", w.opts.connectRetryDelay, err)
+			select {
+			case <-time.After(w.opts.connectRetryDelay):
+			case <-w.stop:
+				return err
+			}
+		}
+
+		if err = w.connect(sub.q); err == nil {
+			return nil
+		}
+		w.notifyConn(ConnEvent{Type: ConnError, Topic: sub.topic, Channel: sub.channel, Err: err})
+	}
+
+	return err
+}
+
+func (w *Worker) connect(q *nsq.Consumer) error {
+	if len(w.opts.lookupdAddrs) > 0 {
+		return q.ConnectToNSQLookupds(w.opts.lookupdAddrs)
+	}
+
+	if len(w.opts.nsqdAddrs) == 0 {
+		if err := w.connectNSQD(q, w.opts.addr); err != nil && !errors.Is(err, nsq.ErrAlreadyConnected) {
+			return err
+		}
+		return nil
+	}
+
+	var errs []string
+	for _, addr := range w.opts.nsqdAddrs {
+		if err := w.connectNSQD(q, addr); err != nil && !errors.Is(err, nsq.ErrAlreadyConnected) {
+			errs = append(errs, addr+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("could not connect nsq server: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// pendingConn is a connection to nsqd which didn't complete within the connect timeout
+type pendingConn struct {
+	q    *nsq.Consumer
+	addr string
+}
+
+// connectNSQD connects q to the nsqd at addr within the connect timeout. The next attempt
+// after a timeout waits for the pending handshake, NSQ reports it as already connected.
+func (w *Worker) connectNSQD(q *nsq.Consumer, addr string) error {
+	if w.opts.connectTimeout <= 0 {
+		return q.ConnectToNSQD(addr)
+	}
+
+	key := pendingConn{q: q, addr: addr}
+	var done chan error
+	if v, ok := w.pendingConns.LoadAndDelete(key); ok {
+		done = v.(chan error)
+	} else {
+		done = make(chan error, 1)
+		go func() {
+			done <- q.ConnectToNSQD(addr)
+		}()
+	}
+
+	timer := time.NewTimer(w.opts.connectTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		w.pendingConns.Store(key, done)
+		return fmt.Errorf("could not connect nsqd %s within %s", addr, w.opts.connectTimeout)
+	}
+}
+
+// Run start the worker
+func (w *Worker) Run(ctx context.Context, task core.QueuedMessage) error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		// the message of the job has been requeued by Shutdown
+		return queue.ErrQueueShutdown
+	}
+
+	w.incBusyWorker()
+	defer w.decBusyWorker()
+
+	runCtx, cancel := w.jobContext(ctx)
+	defer cancel()
+
+	v, ok := w.inflight.Load(task)
+	if !ok {
+		w.mu.RLock()
+		sub := w.subs[0]
+		w.mu.RUnlock()
+		return w.runJob(runCtx, task, sub, nil)
+	}
+	d := v.(*delivery)
+
+	if w.duplicate(d.msg) {
+		w.inflight.Delete(task)
+		d.msg.Finish()
+		return nil
+	}
+
+	if w.opts.autoTouchInterval > 0 {
+		stopTouch := w.autoTouch(d.msg)
+		defer stopTouch()
+	} else {
+		w.checkTimeout(task)
+	}
+
+	if d.decoded != nil {
+		runCtx = context.WithValue(runCtx, protoMessageKey{}, d.decoded)
+	}
+	atomic.AddInt32(&d.running, 1)
+	err := w.runJob(runCtx, task, d.sub, d.msg)
+	atomic.AddInt32(&d.running, -1)
+	if err == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		// the queue failed the job once it timed out, requeue its message
+		// even when the run func ignored ctx.
+		err = ctx.Err()
+	}
+	if err == nil {
+		w.recordHandled(d.msg)
+	}
+	if errors.Is(err, ErrDrop) {
+		w.inflight.Delete(task)
+		d.msg.Finish()
+		// the job is done, don't let the queue retry it.
+		return nil
+	}
+	w.respond(ctx, task, d, err)
+
+	return err
+}
+
+// checkTimeout warns when the timeout of the job is longer than the msg timeout set by
+// WithMsgTimeout, nsqd redelivers the message while the job is still running.
+func (w *Worker) checkTimeout(task core.QueuedMessage) {
+	w.mu.RLock()
+	msgTimeout := w.cfg.MsgTimeout
+	w.mu.RUnlock()
+
+	m, ok := task.(*job.Message)
+	if !ok || msgTimeout <= 0 || m.Timeout <= msgTimeout {
+		return
+	}
+
+	w.timeoutWarning.Do(func() {
+		w.opts.logger.Errorf("job timeout %s exceeds the msg timeout %s, nsqd can redeliver the message "+
+			"of a running job, see WithAutoTouch", m.Timeout, msgTimeout)
+	})
+}
+
+// logFailure logs the error of a job with its NSQ message, if any
+func (w *Worker) logFailure(sub *subscription, msg *nsq.Message, err error) {
+	if msg == nil {
+		w.opts.logger.Errorf("job failed on topic %s channel %s: %s", sub.topic, sub.channel, err)
+		return
+	}
+
+	w.opts.logger.Errorf("job failed on topic %s channel %s, message %s attempt %d: %s",
+		sub.topic, sub.channel, msg.ID, msg.Attempts, err)
+}
+
+// jobContext returns the context of a job run with ctx, it's derived from
+// the base context and canceled once ctx is done.
+func (w *Worker) jobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	parent := ctx
+	if w.opts.baseContext != nil {
+		parent = w.opts.baseContext()
+	}
+
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok && parent != ctx {
+		runCtx, cancel = context.WithDeadline(parent, deadline)
+	} else {
+		runCtx, cancel = context.WithCancel(parent)
+	}
+
+	if parent != ctx {
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+	}
+
+	return runCtx, cancel
+}
+
+// execute calls run with the job, its context is canceled once stop is closed.
+// A panic of run is recovered and returned as a *PanicError.
+func execute(ctx context.Context, run RunFunc, task core.QueuedMessage, stop <-chan struct{}) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = &PanicError{Value: p, Stack: debug.Stack()}
+		}
+	}()
+
+	return run(ctx, task)
+}
+
+// runJob executes the run func and records its metrics and span
+func (w *Worker) runJob(ctx context.Context, task core.QueuedMessage, sub *subscription, msg *nsq.Message) (err error) {
+	start := time.Now()
+	e := w.unwrap(msg)
+	if len(e.Metadata) > 0 {
+		ctx = context.WithValue(ctx, metadataKey{}, e.Metadata)
+	}
+	if msg != nil {
+		ctx = context.WithValue(ctx, messageInfoKey{}, MessageInfo{
+			ID:        msg.ID,
+			Timestamp: time.Unix(0, msg.Timestamp),
+			Attempts:  msg.Attempts,
+		})
+	}
+	ctx, span := w.startRunSpan(ctx, task, sub, msg, e.Trace)
+
+	err = execute(ctx, sub.run, task, w.stop)
+	endSpan(span, err)
+	if err != nil {
+		atomic.AddUint64(&w.failed, 1)
+	} else {
+		atomic.AddUint64(&w.processed, 1)
+	}
+	var pe *PanicError
+	switch {
+	case errors.As(err, &pe):
+		sub.metrics.incPanicked()
+		w.logFailure(sub, msg, fmt.Errorf("%w\n%s", err, pe.Stack))
+	case err != nil:
+		sub.metrics.observe(time.Since(start), err)
+		w.logFailure(sub, msg, err)
+	default:
+		sub.metrics.observe(time.Since(start), nil)
+		if w.opts.successFunc != nil {
+			w.opts.successFunc(task, time.Since(start))
+		}
+		return nil
+	}
+
+	if w.opts.errorFunc != nil {
+		w.opts.errorFunc(task, err)
+	}
+
+	return err
+}
+
+// autoTouch resets the server-side timeout of msg until the returned func is called.
+func (w *Worker) autoTouch(msg *nsq.Message) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(w.opts.autoTouchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				msg.Touch()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// respond sends FIN or REQ for the message of d once the queue is done with the job.
+func (w *Worker) respond(ctx context.Context, task core.QueuedMessage, d *delivery, err error) {
+	if err != nil && ctx.Err() == nil {
+		if m, ok := task.(*job.Message); ok && m.RetryCount > 0 {
+			// the queue retries the job, keep the message in flight.
+			go w.awaitRetry(ctx, task, d)
+			return
+		}
+	}
+
+	w.inflight.Delete(task)
+	if err != nil {
+		d.sub.metrics.incRequeued()
+		atomic.AddUint64(&w.requeued, 1)
+		var re RequeueError
+		if errors.As(err, &re) {
+			delay := re.Delay
+			// NSQ only bounds the default delay.
+			if w.opts.maxRequeueDelay > 0 && delay > w.opts.maxRequeueDelay {
+				delay = w.opts.maxRequeueDelay
+			}
+			d.msg.Requeue(delay)
+			return
+		}
+		d.msg.Requeue(-1)
+		return
+	}
+	d.msg.Finish()
+}
+
+// awaitRetry requeues the message kept in flight for the retry of a job when ctx is done
+// first, the queue gives up on the job once its timeout expires during the retry delay.
+func (w *Worker) awaitRetry(ctx context.Context, task core.QueuedMessage, d *delivery) {
+	select {
+	case <-ctx.Done():
+	case <-w.stop:
+		// shutdown requeues the jobs in flight.
+		return
+	}
+
+	if v, ok := w.inflight.Load(task); !ok || v != d || atomic.LoadInt32(&d.running) > 0 {
+		// the job was responded to or is retried, Run requeues it on ctx.
+		return
+	}
+	w.inflight.Delete(task)
+	d.msg.Requeue(-1)
+}
+
+// Shutdown worker
+func (w *Worker) Shutdown() error {
+	if w.opts.shutdownTimeout <= 0 {
+		return w.ShutdownContext(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.shutdownTimeout)
+	defer cancel()
+
+	err := w.ShutdownContext(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("shutdown timed out after %s with %d jobs running: %w", w.opts.shutdownTimeout, w.Usage(), err)
+	}
+	return err
+}
+
+// ShutdownContext stops the worker and waits for the running jobs
+// until they're done or ctx is done, in which case ctx.Err() is returned
+func (w *Worker) ShutdownContext(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
+		return queue.ErrQueueShutdown
+	}
+
+	var err error
+	w.stopOnce.Do(func() {
+		err = w.shutdown(ctx)
+	})
+	return err
+}
+
+func (w *Worker) shutdown(ctx context.Context) error {
+	// notify shtdown event to worker and consumer
+	close(w.stop)
+	// wait for a consumer being started and keep it from starting later.
+	w.startOnce.Do(func() {})
+	// wait for the running jobs, their context has been canceled.
+	err := w.waitJobs(ctx)
+
+	// stop producer and consumer
+	stopped := true
+	w.restartMu.Lock()
+	if qs := w.consumers(); qs != nil {
+		if err != nil && w.opts.drainTopic != "" {
+			w.drainJobs()
+		}
+		var cerr error
+		if stopped, cerr = w.stopConsumers(ctx, qs); err == nil {
+			err = cerr
+		}
+	}
+	w.restartMu.Unlock()
+	if w.p != nil {
+		// flush the pending publishes, Stop fails them.
+		if perr := w.waitPublishes(ctx); err == nil {
+			err = perr
+		}
+		w.p.Stop()
+	}
+	// the producer reports the pending async publishes before Stop returns.
+	w.publishOnce.Do(func() {})
+	close(w.publishDone)
+	w.publishWG.Wait()
+
+	// close task channel, unless the handlers of the consumer are still running.
+	if stopped {
+		close(w.tasks)
+	}
+
+	return err
+}
+
+// drainJobs publishes the messages in flight to the drain topic before the consumers stop,
+// the ones which can't be published are requeued.
+func (w *Worker) drainJobs() {
+	w.inflight.Range(func(task, v interface{}) bool {
+		w.inflight.Delete(task)
+		d := v.(*delivery)
+		if err := w.p.Publish(w.opts.drainTopic, d.msg.Body); err != nil {
+			w.opts.logger.Errorf("could not publish message %s to drain topic %s: %s",
+				d.msg.ID, w.opts.drainTopic, err)
+			d.msg.Requeue(-1)
+			return true
+		}
+		d.msg.Finish()
+		return true
+	})
+}
+
+// stopConsumers stops the consumers qs of w.subs and their connection watchers,
+// the jobs still in flight are requeued. stopped is false when ctx is done first.
+func (w *Worker) stopConsumers(ctx context.Context, qs []*nsq.Consumer) (stopped bool, err error) {
+	for _, q := range qs {
+		q.ChangeMaxInFlight(0)
+	}
+	// re-queue the jobs which are still in flight.
+	w.inflight.Range(func(task, d interface{}) bool {
+		w.inflight.Delete(task)
+		d.(*delivery).msg.Requeue(-1)
+		return true
+	})
+	for _, q := range qs {
+		q.Stop()
+	}
+	stopped = true
+	for _, q := range qs {
+		select {
+		case <-q.StopChan:
+		case <-ctx.Done():
+			stopped = false
+			err = ctx.Err()
+		}
+	}
+	// report the connections closed by the consumers.
+	if w.connStop != nil {
+		close(w.connStop)
+		w.connStop = nil
+	}
+	w.connWG.Wait()
+	if w.opts.connListener != nil {
+		w.checkConns()
+	}
+
+	return stopped, err
+}
+
+// waitJobs waits until no job is running in Run or ctx is done
+func (w *Worker) waitJobs(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for w.Usage() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// waitPublishes waits until no publish is pending or ctx is done
+func (w *Worker) waitPublishes(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&w.publishing) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// beginPublish counts a publish until endPublish, unless the worker is shutdown
+func (w *Worker) beginPublish() error {
+	atomic.AddInt64(&w.publishing, 1)
+	// shutdown waits for the publishes counted before it started.
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		w.endPublish()
+		return queue.ErrQueueShutdown
+	}
+
+	return nil
+}
+
+func (w *Worker) endPublish() {
+	atomic.AddInt64(&w.publishing, -1)
+}
+
+func (w *Worker) checkProducer() error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return queue.ErrQueueShutdown
+	}
+
+	if w.p == nil {
+		return ErrProducerNotConfigured
+	}
+
+	return nil
+}
+
+// Queue send notification to queue
+func (w *Worker) Queue(job core.QueuedMessage) error {
+	return w.QueueContext(context.Background(), job)
+}
+
+// QueueContext send notification to queue with the trace context of ctx
+func (w *Worker) QueueContext(ctx context.Context, job core.QueuedMessage) error {
+	return w.queue(ctx, job, nil)
+}
+
+// QueueWithMetadata send notification to queue with the metadata,
+// the run func reads it with MetadataFromContext
+func (w *Worker) QueueWithMetadata(job core.QueuedMessage, md map[string]string) error {
+	return w.queue(context.Background(), job, md)
+}
+
+func (w *Worker) queue(ctx context.Context, job core.QueuedMessage, md map[string]string) (err error) {
+	if err := w.checkProducer(); err != nil {
+		return err
+	}
+
+	ctx, span := w.startPublishSpan(ctx)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	body, err := w.encode(job)
+	if err != nil {
+		return err
 	}
 
-	w.cfg = nsq.NewConfig()
-	w.cfg.MaxInFlight = w.opts.maxInFlight
+	if body, err = w.wrap(ctx, body, md); err != nil {
+		return err
+	}
 
-	if err := w.startProducer(); err != nil {
-		panic(err)
+	if body, err = w.compress(body); err != nil {
+		return err
 	}
 
-	return w
+	return w.publish(func(done chan *nsq.ProducerTransaction) error {
+		return w.p.PublishAsync(w.opts.topic, body, done)
+	})
 }
 
-func (w *Worker) startProducer() error {
-	var err error
+// publish calls fn following the queue full policy and reports its duration to the observer, if any
+func (w *Worker) publish(fn func(chan *nsq.ProducerTransaction) error) error {
+	if err := w.beginPublish(); err != nil {
+		return err
+	}
+	defer w.endPublish()
+
+	start := time.Now()
+	var deadline time.Time
+	if w.opts.queueFullPolicy == BlockOnQueueFull {
+		deadline = start.Add(w.opts.publishTimeout)
+	}
+	err := w.attemptPublish(fn, deadline)
+	switch w.opts.queueFullPolicy {
+	case RetryOnQueueFull:
+		delay := w.opts.publishRetryDelay
+		for i := 1; i < w.opts.publishRetryAttempts && w.retryPublish(err, delay); i++ {
+			err = w.attemptPublish(fn, deadline)
+			delay *= 2
+		}
+	case BlockOnQueueFull:
+		delay := w.opts.publishRetryDelay
+		for {
+			wait := time.Until(deadline)
+			if wait > delay {
+				wait = delay
+			}
+			if wait <= 0 || !w.retryPublish(err, wait) {
+				break
+			}
+			err = w.attemptPublish(fn, deadline)
+			delay *= 2
+		}
+		if err != nil && !time.Now().Before(deadline) {
+			err = fmt.Errorf("publish not acknowledged within %s: %w", w.opts.publishTimeout, err)
+		}
+	}
 
-	w.p, err = nsq.NewProducer(w.opts.addr, w.cfg)
+	if w.opts.publishObserver != nil {
+		w.opts.publishObserver(time.Since(start), err)
+	}
 
 	return err
 }
 
-func (w *Worker) startConsumer() (err error) {
-	w.startOnce.Do(func() {
-		w.q, err = nsq.NewConsumer(w.opts.topic, w.opts.channel, w.cfg)
-		if err != nil {
-			return
+// attemptPublish publishes with fn and waits for nsqd to acknowledge it. With a non-zero
+// deadline it gives up at the deadline, nsqd may still acknowledge the publish later.
+func (w *Worker) attemptPublish(fn func(chan *nsq.ProducerTransaction) error, deadline time.Time) error {
+	// buffered, the router of the producer never waits for an abandoned attempt
+	done := make(chan *nsq.ProducerTransaction, 1)
+	if deadline.IsZero() {
+		if err := fn(done); err != nil {
+			return err
 		}
+		return (<-done).Error
+	}
 
-		w.q.AddHandler(nsq.HandlerFunc(func(msg *nsq.Message) error {
-			if len(msg.Body) == 0 {
-				// Returning nil will automatically send a FIN command to NSQ to mark the message as processed.
-				// In this case, a message with an empty body is simply ignored/discarded.
-				return nil
-			}
-
-		loop:
-			for {
-				select {
-				case w.tasks <- msg:
-					break loop
-				case <-w.stop:
-					if msg != nil {
-						// re-queue the job if worker has been shutdown.
-						msg.Requeue(-1)
-					}
-					break loop
-				case <-time.After(2 * time.Second):
-					msg.Touch()
-				}
-			}
+	go func() {
+		// fn connects the producer first, which waits for the handshake of nsqd
+		if err := fn(done); err != nil {
+			done <- &nsq.ProducerTransaction{Error: err}
+		}
+	}()
 
-			return nil
-		}))
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
 
-		err = w.q.ConnectToNSQD(w.opts.addr)
-		if err != nil {
-			return
-		}
-	})
+	select {
+	case t := <-done:
+		return t.Error
+	case <-timer.C:
+		return context.DeadlineExceeded
+	}
+}
 
-	return err
+// retryPublish reports whether a publish which failed with err should be retried after delay,
+// it waits for the delay unless the worker is shutdown.
+func (w *Worker) retryPublish(err error, delay time.Duration) bool {
+	if err == nil || errors.Is(err, nsq.ErrStopped) {
+		return false
+	}
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-w.stop:
+		return false
+	}
 }
 
-// Run start the worker
-func (w *Worker) Run(ctx context.Context, task core.QueuedMessage) error {
-	return w.opts.runFunc(ctx, task)
+// QueueAsync send notification to queue without waiting for nsqd,
+// the result is reported to the func set by WithPublishCallback
+func (w *Worker) QueueAsync(job core.QueuedMessage) error {
+	if err := w.checkProducer(); err != nil {
+		return err
+	}
+
+	body, err := w.encode(job)
+	if err == nil {
+		body, err = w.compress(body)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.publishOnce.Do(func() {
+		results := make(chan *nsq.ProducerTransaction)
+		w.publishWG.Add(2)
+		go w.publishLoop(results)
+		go w.callbackLoop(results)
+	})
+
+	if err := w.beginPublish(); err != nil {
+		return err
+	}
+	if err := w.p.PublishAsync(w.opts.topic, body, w.published, job); err != nil {
+		w.endPublish()
+		return err
+	}
+
+	return nil
 }
 
-// Shutdown worker
-func (w *Worker) Shutdown() error {
-	if !atomic.CompareAndSwapInt32(&w.stopFlag, 0, 1) {
-		return queue.ErrQueueShutdown
+// publishLoop queues the results of QueueAsync for callbackLoop. The router of the producer
+// waits for every result to be received, it must not wait for the callback too.
+func (w *Worker) publishLoop(results chan<- *nsq.ProducerTransaction) {
+	defer w.publishWG.Done()
+
+	var pending []*nsq.ProducerTransaction
+	for {
+		var out chan<- *nsq.ProducerTransaction
+		var next *nsq.ProducerTransaction
+		if len(pending) > 0 {
+			out, next = results, pending[0]
+		}
+
+		select {
+		case t := <-w.published:
+			pending = append(pending, t)
+		case out <- next:
+			pending[0] = nil
+			pending = pending[1:]
+		case <-w.publishDone:
+			return
+		}
 	}
+}
 
-	w.stopOnce.Do(func() {
-		// notify shtdown event to worker and consumer
-		close(w.stop)
-		// stop producer and consumer
-		if w.q != nil {
-			w.q.ChangeMaxInFlight(0)
-			w.q.Stop()
-			<-w.q.StopChan
+// callbackLoop reports the results of QueueAsync in their order, the callback may publish again
+func (w *Worker) callbackLoop(results <-chan *nsq.ProducerTransaction) {
+	defer w.publishWG.Done()
+
+	for {
+		select {
+		case t := <-results:
+			job, _ := t.Args[0].(core.QueuedMessage)
+			if w.opts.publishFunc != nil {
+				w.opts.publishFunc(job, t.Error)
+			} else if t.Error != nil {
+				w.opts.logger.Errorf("could not publish message: %s", t.Error)
+			}
+			w.endPublish()
+		case <-w.publishDone:
+			return
 		}
-		w.p.Stop()
+	}
+}
 
-		// close task channel
-		close(w.tasks)
+// QueueWithDelay send notification to queue, nsqd delivers it after delay
+func (w *Worker) QueueWithDelay(job core.QueuedMessage, delay time.Duration) error {
+	if err := w.checkProducer(); err != nil {
+		return err
+	}
+
+	body, err := w.encode(job)
+	if err == nil {
+		body, err = w.compress(body)
+	}
+	if err != nil {
+		return err
+	}
+
+	return w.publish(func(done chan *nsq.ProducerTransaction) error {
+		return w.p.DeferredPublishAsync(w.opts.topic, delay, body, done)
 	})
-	return nil
 }
 
-// Queue send notification to queue
-func (w *Worker) Queue(job core.QueuedMessage) error {
-	if atomic.LoadInt32(&w.stopFlag) == 1 {
-		return queue.ErrQueueShutdown
+// QueueBatch send the notifications to queue in a single request
+func (w *Worker) QueueBatch(jobs []core.QueuedMessage) error {
+	if err := w.checkProducer(); err != nil {
+		return err
+	}
+
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	bodies := make([][]byte, 0, len(jobs))
+	for _, job := range jobs {
+		body, err := w.encode(job)
+		if err == nil {
+			body, err = w.compress(body)
+		}
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, body)
 	}
 
-	return w.p.Publish(w.opts.topic, job.Bytes())
+	return w.publish(func(done chan *nsq.ProducerTransaction) error {
+		return w.p.MultiPublishAsync(w.opts.topic, bodies, done)
+	})
 }
 
 // Request fetch new task from queue
 func (w *Worker) Request() (core.QueuedMessage, error) {
+	if w.opts.producerOnly {
+		return nil, ErrConsumerNotConfigured
+	}
+
 	if err := w.startConsumer(); err != nil {
 		return nil, err
 	}
@@ -144,12 +1483,43 @@ func (w *Worker) Request() (core.QueuedMessage, error) {
 loop:
 	for {
 		select {
-		case task, ok := <-w.tasks:
+		case d, ok := <-w.tasks:
 			if !ok {
 				return nil, queue.ErrQueueHasBeenClosed
 			}
+			body, err := decompress(d.msg.Body)
+			if err != nil {
+				w.opts.logger.Errorf("could not decompress message %s: %s", d.msg.ID, err)
+				w.rejectInvalid(d.msg)
+				continue
+			}
+			if w.opts.transform != nil {
+				if body, err = w.opts.transform(body); err != nil {
+					w.opts.logger.Errorf("could not transform message %s: %s", d.msg.ID, err)
+					w.rejectInvalid(d.msg)
+					continue
+				}
+			}
+			// the metadata of the job is read from the decoded body too.
+			d.msg.Body = body
 			var data job.Message
-			_ = json.Unmarshal(task.Body, &data)
+			if d.decoded, err = w.decode(d.msg.Body, &data); err != nil {
+				w.opts.logger.Errorf("could not decode message %s: %s", d.msg.ID, err)
+				w.rejectInvalid(d.msg)
+				continue
+			}
+			if data.Timeout <= 0 {
+				data.Timeout = w.opts.defaultTimeout
+			}
+			w.inflight.Store(&data, d)
+			select {
+			case <-w.stop:
+				// shutdown may have requeued the jobs in flight before it was stored.
+				w.inflight.Delete(&data)
+				d.msg.Requeue(-1)
+				return nil, queue.ErrQueueShutdown
+			default:
+			}
 			return &data, nil
 		case <-time.After(1 * time.Second):
 			if clock == 5 {
@@ -162,11 +1532,395 @@ loop:
 	return nil, queue.ErrNoTaskInQueue
 }
 
-// Stats retrieves the current connection and message statistics for a Consumer
+// rejectInvalid responds to a message which can't be handed to the queue
+func (w *Worker) rejectInvalid(msg *nsq.Message) {
+	if w.opts.invalidMessagePolicy == RequeueInvalidMessage {
+		msg.Requeue(-1)
+		return
+	}
+	msg.Finish()
+}
+
+// Pause stops the delivery of new messages, the running jobs aren't affected
+func (w *Worker) Pause() error {
+	qs, err := w.startedConsumers()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if atomic.CompareAndSwapInt32(&w.paused, 0, 1) {
+		for _, q := range qs {
+			q.ChangeMaxInFlight(0)
+		}
+	}
+
+	return nil
+}
+
+// Resume restarts the delivery of messages stopped by Pause
+func (w *Worker) Resume() error {
+	if _, err := w.startedConsumers(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if atomic.CompareAndSwapInt32(&w.paused, 1, 0) {
+		for _, sub := range w.subs {
+			sub.q.ChangeMaxInFlight(w.maxInFlight(sub, sub.q.Stats().Connections))
+		}
+	}
+
+	return nil
+}
+
+// SetMaxInFlight changes the number of messages each consumer can have in flight,
+// a paused consumer uses it once resumed
+func (w *Worker) SetMaxInFlight(n int) error {
+	if n <= 0 {
+		return errors.New("max in flight must be positive")
+	}
+
+	if _, err := w.startedConsumers(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.opts.maxInFlight = n
+	if atomic.LoadInt32(&w.paused) == 0 {
+		for _, sub := range w.subs {
+			sub.q.ChangeMaxInFlight(w.maxInFlight(sub, sub.q.Stats().Connections))
+		}
+	}
+
+	return nil
+}
+
+// Restart replaces the consumers with the ones of the options given to NewWorker and
+// the previous restarts followed by opts, once the running jobs are done. Only the topics,
+// channels, run funcs, max in flight and NSQ config of the consumers change, the producer
+// and the other options are kept. The consumers are drained within the shutdown timeout,
+// they keep running when it's exceeded. Consumers not started yet by Request start with
+// the new options.
+func (w *Worker) Restart(opts ...Option) error {
+	if w.opts.producerOnly {
+		return ErrConsumerNotConfigured
+	}
+
+	w.restartMu.Lock()
+	defer w.restartMu.Unlock()
+
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return queue.ErrQueueShutdown
+	}
+
+	base := newOptions(w.options...)
+	options := append(append([]Option(nil), w.options...), opts...)
+	o := newOptions(options...)
+	subs, err := w.newSubscriptions(&o)
+	if err != nil {
+		return err
+	}
+	cfg, err := newConfig(o)
+	if err != nil {
+		return err
+	}
+	if err = registerMetrics(subs, o.registerer); err != nil {
+		return err
+	}
+	// keep the max in flight changed by SetMaxInFlight unless opts change it.
+	maxInFlight := 0
+	if o.maxInFlight != base.maxInFlight {
+		maxInFlight = o.maxInFlight
+	}
+
+	qs := w.consumers()
+	if qs == nil {
+		w.swapConsumers(subs, cfg, options, maxInFlight)
+		return nil
+	}
+
+	ctx := context.Background()
+	if w.opts.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.opts.shutdownTimeout)
+		defer cancel()
+	}
+
+	for _, q := range qs {
+		q.ChangeMaxInFlight(0)
+	}
+	if err = w.waitJobs(ctx); err != nil {
+		w.mu.Lock()
+		if atomic.LoadInt32(&w.paused) == 0 {
+			for _, sub := range w.subs {
+				sub.q.ChangeMaxInFlight(w.maxInFlight(sub, sub.q.Stats().Connections))
+			}
+		}
+		w.mu.Unlock()
+		return fmt.Errorf("restart timed out with %d jobs running: %w", w.Usage(), err)
+	}
+	if _, err = w.stopConsumers(ctx, qs); err != nil {
+		return err
+	}
+
+	w.swapConsumers(subs, cfg, options, maxInFlight)
+
+	return w.startConsumers(subs, cfg, nil)
+}
+
+// swapConsumers replaces the subscriptions and NSQ config of the consumers for Restart,
+// maxInFlight replaces the max in flight of the worker when it's set. The caller holds w.restartMu.
+func (w *Worker) swapConsumers(subs []*subscription, cfg *nsq.Config, options []Option, maxInFlight int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.subs = subs
+	w.cfg = cfg
+	w.options = options
+	w.restarted = true
+	if maxInFlight > 0 {
+		w.opts.maxInFlight = maxInFlight
+	}
+	// the new consumers keep the max in flight and the pause of the worker.
+	cfg.MaxInFlight = w.maxInFlight(subs[0], 1)
+	if atomic.LoadInt32(&w.paused) == 1 {
+		cfg.MaxInFlight = 0
+	}
+}
+
+// maxInFlight returns the max in flight of the consumer of sub with conns connections,
+// capped to the max in flight per connection, lowered by the running jobs with
+// WithBackpressure and zero while it's throttled. The caller holds w.mu.
+func (w *Worker) maxInFlight(sub *subscription, conns int) int {
+	if sub.throttled {
+		return 0
+	}
+
+	n := w.opts.maxInFlight
+	if w.opts.maxInFlightPerConn > 0 {
+		if conns < 1 {
+			conns = 1
+		}
+		if c := w.opts.maxInFlightPerConn * conns; c < n {
+			n = c
+		}
+	}
+
+	if w.opts.backpressure {
+		// the capacity left in the worker, Capacity would lock w.mu.
+		if free := w.opts.maxInFlight*len(w.subs) - w.Usage(); free < n {
+			n = free
+		}
+		if n < 0 {
+			n = 0
+		}
+	}
+
+	return n
+}
+
+// startedConsumers returns the consumers if they're running
+func (w *Worker) startedConsumers() ([]*nsq.Consumer, error) {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return nil, queue.ErrQueueShutdown
+	}
+
+	qs := w.consumers()
+	if qs == nil {
+		return nil, ErrConsumerNotStarted
+	}
+
+	return qs, nil
+}
+
+// consumers returns the consumers of the topics, nil until they're started by Request
+func (w *Worker) consumers() []*nsq.Consumer {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.subs[0].q == nil {
+		return nil
+	}
+
+	qs := make([]*nsq.Consumer, 0, len(w.subs))
+	for _, sub := range w.subs {
+		qs = append(qs, sub.q)
+	}
+
+	return qs
+}
+
+// Stats retrieves the current connection and message statistics summed up for the consumers
 func (w *Worker) Stats() *nsq.ConsumerStats {
-	if w.q == nil {
+	qs := w.consumers()
+	if qs == nil {
 		return nil
 	}
 
-	return w.q.Stats()
+	stats := &nsq.ConsumerStats{}
+	for _, q := range qs {
+		s := q.Stats()
+		stats.MessagesReceived += s.MessagesReceived
+		stats.MessagesFinished += s.MessagesFinished
+		stats.MessagesRequeued += s.MessagesRequeued
+		stats.Connections += s.Connections
+	}
+
+	return stats
+}
+
+// Connections returns the number of nsqd connections held by the consumers, zero until
+// they're started. It's lower than the nsqd nodes discovered when some can't be reached.
+func (w *Worker) Connections() int {
+	stats := w.Stats()
+	if stats == nil {
+		return 0
+	}
+
+	return stats.Connections
+}
+
+// Processed returns the number of jobs run by the worker which succeeded
+func (w *Worker) Processed() uint64 {
+	return atomic.LoadUint64(&w.processed)
+}
+
+// Failed returns the number of jobs run by the worker which returned an error or panicked
+func (w *Worker) Failed() uint64 {
+	return atomic.LoadUint64(&w.failed)
+}
+
+// Requeued returns the number of messages the worker requeued because their job failed
+func (w *Worker) Requeued() uint64 {
+	return atomic.LoadUint64(&w.requeued)
+}
+
+// InFlight returns the number of messages delivered by nsqd to the consumers
+// which haven't been finished or requeued yet
+func (w *Worker) InFlight() int {
+	stats := w.Stats()
+	if stats == nil {
+		return 0
+	}
+
+	return int(stats.MessagesReceived - stats.MessagesFinished - stats.MessagesRequeued)
+}
+
+// Ping reports whether the consumer is connected to nsqd and the producer can reach nsqd
+func (w *Worker) Ping() error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return queue.ErrQueueShutdown
+	}
+
+	if !w.opts.producerOnly {
+		qs := w.consumers()
+		if qs == nil {
+			return errors.New("consumer not connected")
+		}
+		for _, q := range qs {
+			if q.Stats().Connections == 0 {
+				return errors.New("consumer not connected")
+			}
+		}
+	}
+
+	if w.p != nil {
+		return w.p.Ping()
+	}
+
+	return nil
+}
+
+// Validate checks the nsqd and nsqlookupd of the worker can be reached with its config,
+// including the TLS and auth negotiation with nsqd, without consuming any message
+func (w *Worker) Validate() error {
+	if atomic.LoadInt32(&w.stopFlag) == 1 {
+		return queue.ErrQueueShutdown
+	}
+
+	var errs []string
+	if w.p != nil {
+		if err := w.p.Ping(); err != nil {
+			errs = append(errs, "producer "+w.opts.producerAddr+": "+err.Error())
+		}
+	}
+
+	if !w.opts.producerOnly {
+		for _, addr := range w.opts.lookupdAddrs {
+			if err := pingLookupd(addr); err != nil {
+				errs = append(errs, "nsqlookupd "+addr+": "+err.Error())
+			}
+		}
+
+		var addrs []string
+		switch {
+		case len(w.opts.lookupdAddrs) > 0:
+			// nsqlookupd discovers the nsqd addresses.
+		case len(w.opts.nsqdAddrs) > 0:
+			addrs = w.opts.nsqdAddrs
+		default:
+			addrs = []string{w.opts.addr}
+		}
+		for _, addr := range addrs {
+			if err := w.pingNSQD(addr); err != nil {
+				errs = append(errs, "consumer "+addr+": "+err.Error())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid worker: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// pingNSQD connects to the nsqd at addr like a consumer would and disconnects
+func (w *Worker) pingNSQD(addr string) error {
+	w.mu.RLock()
+	cfg := w.cfg
+	w.mu.RUnlock()
+
+	p, err := nsq.NewProducer(addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Stop()
+
+	p.SetLogger(nsqLogger{logger: w.opts.logger}, w.opts.nsqLogLevel)
+
+	return p.Ping()
+}
+
+// Capacity returns the maximum number of messages in flight for the worker
+func (w *Worker) Capacity() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.opts.maxInFlight * len(w.subs)
+}
+
+// Usage returns the number of jobs running in the worker
+func (w *Worker) Usage() int {
+	busy := atomic.LoadUint64(&w.busyWorkers)
+	if busy > math.MaxInt {
+		return math.MaxInt
+	}
+
+	return int(busy)
+}
+
+func (w *Worker) incBusyWorker() {
+	atomic.AddUint64(&w.busyWorkers, 1)
+}
+
+func (w *Worker) decBusyWorker() {
+	atomic.AddUint64(&w.busyWorkers, ^uint64(0))
 }
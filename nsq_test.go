@@ -1,11 +1,22 @@
 package nsq
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,8 +24,18 @@ import (
 	"github.com/golang-queue/queue/core"
 	"github.com/golang-queue/queue/job"
 
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/goleak"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var host = "127.0.0.1"
@@ -31,15 +52,23 @@ func (m mockMessage) Bytes() []byte {
 	return []byte(m.Message)
 }
 
+// newJob wraps m the same way as queue.Queue does before calling Worker.Queue
+func newJob(m core.QueuedMessage, opts ...job.Option) *job.Message {
+	return &job.Message{
+		Payload: job.NewMessage(m, opts...).Encode(),
+	}
+}
+
 func TestNSQDefaultFlow(t *testing.T) {
 	m := &mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("test1"),
 		WithChannel("test1"),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -54,10 +83,11 @@ func TestNSQDefaultFlow(t *testing.T) {
 }
 
 func TestNSQShutdown(t *testing.T) {
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("test2"),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -76,7 +106,7 @@ func TestNSQCustomFuncAndWait(t *testing.T) {
 	m := &mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("test3"),
 		WithMaxInFlight(10),
@@ -85,6 +115,7 @@ func TestNSQCustomFuncAndWait(t *testing.T) {
 			return nil
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(10),
@@ -105,9 +136,11 @@ func TestEnqueueJobAfterShutdown(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
-		WithAddr(host + ":4150"),
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("enqueue_job_after_shutdown"),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -127,7 +160,7 @@ func TestJobReachTimeout(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("timeout"),
 		WithMaxInFlight(2),
@@ -148,6 +181,7 @@ func TestJobReachTimeout(t *testing.T) {
 			}
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -164,7 +198,7 @@ func TestCancelJobAfterShutdown(t *testing.T) {
 	m := mockMessage{
 		Message: "test",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("cancel"),
 		WithLogger(queue.NewLogger()),
@@ -185,6 +219,7 @@ func TestCancelJobAfterShutdown(t *testing.T) {
 			}
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -201,7 +236,7 @@ func TestGoroutineLeak(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("GoroutineLeak"),
 		WithLogger(queue.NewEmptyLogger()),
@@ -224,6 +259,7 @@ func TestGoroutineLeak(t *testing.T) {
 			}
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithLogger(queue.NewEmptyLogger()),
 		queue.WithWorker(w),
@@ -246,13 +282,14 @@ func TestGoroutinePanic(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("GoroutinePanic"),
 		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
 			panic("missing something")
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(2),
@@ -272,7 +309,7 @@ func TestNSQStatsinQueue(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("nsq_stats"),
 		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
@@ -280,6 +317,7 @@ func TestNSQStatsinQueue(t *testing.T) {
 			return nil
 		}),
 	)
+	assert.NoError(t, err)
 	q, err := queue.NewQueue(
 		queue.WithWorker(w),
 		queue.WithWorkerCount(1),
@@ -301,15 +339,16 @@ func TestNSQStatsInWorker(t *testing.T) {
 	m := mockMessage{
 		Message: "foo",
 	}
-	w := NewWorker(
+	w, err := NewWorker(
 		WithAddr(host+":4150"),
 		WithTopic("nsq_stats_queue"),
 	)
+	assert.NoError(t, err)
 
 	assert.Equal(t, int(0), len(w.tasks))
-	assert.NoError(t, w.Queue(m))
-	assert.NoError(t, w.Queue(m))
-	assert.NoError(t, w.Queue(m))
+	assert.NoError(t, w.Queue(newJob(m)))
+	assert.NoError(t, w.Queue(newJob(m)))
+	assert.NoError(t, w.Queue(newJob(m)))
 	assert.Nil(t, w.Stats())
 
 	task, err := w.Request()
@@ -318,6 +357,10 @@ func TestNSQStatsInWorker(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, uint64(1), w.Stats().MessagesReceived)
+	// the message stays in flight until the job is done
+	assert.Equal(t, uint64(0), w.Stats().MessagesFinished)
+	assert.NoError(t, w.Run(context.Background(), task))
+	time.Sleep(50 * time.Millisecond)
 	assert.Equal(t, uint64(1), w.Stats().MessagesFinished)
 	assert.Equal(t, uint64(0), w.Stats().MessagesRequeued)
 	time.Sleep(50 * time.Millisecond)
@@ -325,3 +368,3841 @@ func TestNSQStatsInWorker(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 	assert.Equal(t, uint64(1), w.Stats().MessagesRequeued)
 }
+
+func TestNSQLookupdConsumer(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/lookup", r.URL.Path)
+		assert.Equal(t, "nsq_lookupd", r.URL.Query().Get("topic"))
+		rw.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		_, _ = rw.Write([]byte(`{"channels":[],"producers":[{"broadcast_address":"` +
+			host + `","tcp_port":4150}]}`))
+	}))
+	defer lookupd.Close()
+
+	m := mockMessage{
+		Message: "foo",
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQLookupd(lookupd.Listener.Addr().String()),
+		WithTopic("nsq_lookupd"),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Queue(newJob(m)))
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NotNil(t, task)
+	assert.Equal(t, int(1), w.Stats().Connections)
+	_ = w.Shutdown()
+}
+
+func TestNSQMultipleNSQD(t *testing.T) {
+	nsqd1 := newMockNSQD(t, host+":0")
+	nsqd2 := newMockNSQD(t, host+":0")
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd1.Addr(), nsqd2.Addr()),
+		WithTopic("multiple_nsqd"),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.startConsumer())
+	assert.Equal(t, int(2), w.Stats().Connections)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMultipleNSQDConnectError(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr(), host+":1"),
+		WithTopic("multiple_nsqd_error"),
+	)
+	assert.NoError(t, err)
+
+	err = w.startConsumer()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), host+":1")
+	assert.Equal(t, int(1), w.Stats().Connections)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNewWorkerTopicRequired(t *testing.T) {
+	_, err := NewWorker(
+		WithAddr(host + ":4150"),
+	)
+	assert.EqualError(t, err, "topic is required")
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topic_required"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "ch", w.opts.channel)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNewWorkerInvalidOptions(t *testing.T) {
+	_, err := NewWorker(
+		WithAddr("127.0.0.1"),
+		WithTopic("new_worker_invalid_options"),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("invalid topic"),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("new_worker_invalid_options"),
+		WithChannel("invalid/channel"),
+	)
+	assert.Error(t, err)
+}
+
+func TestNewWorkerTopicChannelNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		channel string
+		valid   bool
+	}{
+		{"valid", "names.valid-1_2", "channel.valid-1_2", true},
+		{"ephemeral", "names#ephemeral", "channel#ephemeral", true},
+		{"topic too long", strings.Repeat("a", 65), "ch", false},
+		{"channel too long", "names", strings.Repeat("a", 65), false},
+		{"topic invalid characters", "names:invalid", "ch", false},
+		{"channel invalid characters", "names", "channel invalid", false},
+		{"topic invalid ephemeral suffix", "names#temp", "ch", false},
+		{"channel invalid ephemeral suffix", "names", "channel#temp", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := NewWorker(
+				WithAddr(host+":4150"),
+				WithTopic(tt.topic),
+				WithChannel(tt.channel),
+			)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, w.Shutdown())
+		})
+	}
+}
+
+func TestNSQConnectRetry(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("connect_retry"),
+		WithConnectRetry(3, 100*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.startConsumer())
+	assert.Equal(t, int(1), w.Stats().Connections)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQConnectRetryThenSuccess(t *testing.T) {
+	// reserve a free port and release it so that the first attempts fail
+	nsqd := newMockNSQD(t, host+":0")
+	addr := nsqd.Addr()
+	nsqd.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(addr),
+		WithTopic("connect_retry_success"),
+		WithConnectRetry(10, 100*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	started := make(chan struct{})
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		newMockNSQD(t, addr)
+		close(started)
+	}()
+
+	assert.NoError(t, w.startConsumer())
+	<-started
+	assert.Equal(t, int(1), w.Stats().Connections)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQConnectRetryExhausted(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	addr := nsqd.Addr()
+	nsqd.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(addr),
+		WithTopic("connect_retry_exhausted"),
+		WithConnectRetry(2, 50*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	assert.Error(t, w.startConsumer())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQReconnect(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	addr := nsqd.Addr()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(addr),
+		WithTopic("reconnect"),
+		// keep the reconnect of NSQ from kicking in first
+		WithLookupdPollInterval(time.Second),
+		WithReconnect(5, 50*time.Millisecond, 200*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+	assert.Equal(t, 1, w.Stats().Connections)
+
+	// nsqd restarts on the same address
+	nsqd.Close()
+	assert.Eventually(t, func() bool {
+		return w.Stats().Connections == 0
+	}, time.Second, 10*time.Millisecond)
+	newMockNSQD(t, addr)
+
+	assert.Eventually(t, func() bool {
+		return w.Stats().Connections == 1
+	}, 800*time.Millisecond, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithTopic("reconnect"),
+		WithReconnect(0, time.Second, time.Second),
+	)
+	assert.Error(t, err)
+	_, err = NewWorker(
+		WithTopic("reconnect"),
+		WithReconnect(1, time.Second, time.Millisecond),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQReconnectExhausted(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	logger := &mockLogger{}
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("reconnect_exhausted"),
+		WithLogger(logger),
+		WithLookupdPollInterval(time.Second),
+		WithReconnect(2, 10*time.Millisecond, 20*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+
+	nsqd.Close()
+	assert.Eventually(t, func() bool {
+		for _, line := range logger.logged() {
+			if strings.HasPrefix(line, "could not reconnect topic reconnect_exhausted channel ch to nsqd, giving up") {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQTLSConfig(t *testing.T) {
+	tlsCfg := &tls.Config{
+		ServerName: "nsqd.example.com",
+		MinVersion: tls.VersionTLS12,
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("tls_config"),
+		WithTLS(tlsCfg),
+	)
+	assert.NoError(t, err)
+	assert.True(t, w.cfg.TlsV1)
+	assert.Equal(t, tlsCfg, w.cfg.TlsConfig)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQAuthSecret(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("auth_secret"),
+		WithAuthSecret("secret"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", w.cfg.AuthSecret)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("auth_secret"),
+		WithAuthSecret(""),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQDeflate(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("deflate"),
+		WithDeflate(9),
+	)
+	assert.NoError(t, err)
+	assert.True(t, w.cfg.Deflate)
+	assert.Equal(t, 9, w.cfg.DeflateLevel)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("deflate"),
+		WithDeflate(10),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQSnappy(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("snappy"),
+		WithSnappy(),
+	)
+	assert.NoError(t, err)
+	assert.True(t, w.cfg.Snappy)
+	assert.False(t, w.cfg.Deflate)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("snappy"),
+		WithSnappy(),
+		WithDeflate(6),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQHeartbeatInterval(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("heartbeat_interval"),
+		WithHeartbeatInterval(45*time.Second),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 45*time.Second, w.cfg.HeartbeatInterval)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("heartbeat_interval"),
+		WithHeartbeatInterval(0),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("heartbeat_interval"),
+		WithHeartbeatInterval(2*time.Minute),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQMsgTimeout(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("msg_timeout"),
+		WithMsgTimeout(5*time.Minute),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, w.cfg.MsgTimeout)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("msg_timeout"),
+		WithMsgTimeout(10*time.Second),
+		WithHeartbeatInterval(20*time.Second),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQAutoTouch(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("auto_touch"),
+		WithAutoTouch(50*time.Millisecond),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, delegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(context.Background(), task))
+
+	touched := delegate.touched()
+	assert.GreaterOrEqual(t, touched, 4)
+	assert.Equal(t, 1, delegate.finished())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, touched, delegate.touched())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQCapacity(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("capacity"),
+		WithMaxInFlight(10),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, w.Capacity())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQUsage(t *testing.T) {
+	started := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("usage"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, w.Usage())
+
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background(), mockMessage{Message: "foo"})
+	}()
+	<-started
+	assert.Equal(t, 1, w.Usage())
+	assert.NoError(t, <-done)
+	assert.Equal(t, 0, w.Usage())
+	assert.NoError(t, w.Shutdown())
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(m *job.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(m)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, m *job.Message) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(m)
+}
+
+func TestNSQCustomCodec(t *testing.T) {
+	rets := make(chan string, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("custom_codec"),
+		WithCodec(gobCodec{}),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			rets <- string(m.Bytes())
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+	q, err := queue.NewQueue(
+		queue.WithWorker(w),
+		queue.WithWorkerCount(1),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, q.Queue(mockMessage{Message: "foo"}, job.WithTimeout(5*time.Second)))
+	q.Start()
+	select {
+	case ret := <-rets:
+		assert.Equal(t, "foo", ret)
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not received")
+	}
+	q.Release()
+}
+
+func TestNSQInvalidMessage(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("invalid_message"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			t.Fatal("handler must not be called")
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	invalid, invalidDelegate := newMockMessage([]byte("{invalid"))
+	valid, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: invalid, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: valid, sub: w.subs[0]}
+	}()
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.Equal(t, 1, invalidDelegate.finished())
+	assert.Empty(t, invalidDelegate.requeued())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQInvalidMessageRequeue(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("invalid_message_requeue"),
+		WithInvalidMessagePolicy(RequeueInvalidMessage),
+	)
+	assert.NoError(t, err)
+
+	invalid, invalidDelegate := newMockMessage([]byte("{invalid"))
+	valid, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: invalid, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: valid, sub: w.subs[0]}
+	}()
+
+	_, err = w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, invalidDelegate.finished())
+	assert.Len(t, invalidDelegate.requeued(), 1)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMaxAttempts(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	dropped := make(chan *nsq.Message, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("max_attempts"),
+		WithMaxAttempts(3),
+		WithDeadLetterFunc(func(msg *nsq.Message) {
+			dropped <- msg
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(3), w.cfg.MaxAttempts)
+
+	body := job.NewMessage(mockMessage{Message: "foo"}).Encode()
+	nsqd.deliver("0000000000000001", body, 4)
+	nsqd.deliver("0000000000000002", body, 3)
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+
+	select {
+	case msg := <-dropped:
+		assert.Equal(t, "0000000000000001", string(msg.ID[:]))
+		assert.Equal(t, uint16(4), msg.Attempts)
+	case <-time.After(time.Second):
+		t.Fatal("message not dropped")
+	}
+
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNSQDeadLetterTopic(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("dead_letter_source"),
+		WithMaxAttempts(3),
+		WithDeadLetterTopic("dead_letter"),
+	)
+	assert.NoError(t, err)
+
+	dlq, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("dead_letter"),
+	)
+	assert.NoError(t, err)
+
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 4)
+	assert.NoError(t, w.startConsumer())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 1
+	}, time.Second, 10*time.Millisecond)
+
+	task, err := dlq.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, dlq.Run(context.Background(), task))
+
+	assert.NoError(t, w.Shutdown())
+	assert.NoError(t, dlq.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("dead_letter_topic"),
+		WithDeadLetterTopic("invalid topic"),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQRequeueError(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("requeue_error"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return fmt.Errorf("downstream unavailable: %w", RequeueError{Delay: 3 * time.Second})
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, delegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+
+	err = w.Run(context.Background(), task)
+	var re RequeueError
+	assert.True(t, errors.As(err, &re))
+	assert.Equal(t, []time.Duration{3 * time.Second}, delegate.requeued())
+	assert.Equal(t, 0, delegate.finished())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQBackoff(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("backoff"),
+		WithMaxBackoffDuration(10*time.Minute),
+		WithBackoffMultiplier(5*time.Second),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, w.cfg.MaxBackoffDuration)
+	assert.Equal(t, 5*time.Second, w.cfg.BackoffMultiplier)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("backoff"),
+		WithMaxBackoffDuration(2*time.Hour),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQBackoffDisabled(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("backoff_disabled"),
+		WithMaxBackoffDuration(10*time.Minute),
+		WithBackoffDisabled(),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), w.cfg.MaxBackoffDuration)
+	assert.Equal(t, time.Duration(0), w.cfg.DefaultRequeueDelay)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQConcurrentHandlers(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("concurrent_handlers"),
+		WithMaxInFlight(3),
+		WithConcurrentHandlers(3),
+	)
+	assert.NoError(t, err)
+
+	body := job.NewMessage(mockMessage{Message: "foo"}).Encode()
+	nsqd.deliver("0000000000000001", body, 1)
+	nsqd.deliver("0000000000000002", body, 1)
+	nsqd.deliver("0000000000000003", body, 1)
+	assert.NoError(t, w.startConsumer())
+
+	// every handler holds a message until it's requested.
+	assert.Eventually(t, func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Count(stacks, "(*messageHandler).HandleMessage") == 3
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	assert.NoError(t, w.Shutdown())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNSQQueueWithDelay(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_with_delay"),
+	)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, w.QueueWithDelay(newJob(mockMessage{Message: "foo"}), 500*time.Millisecond))
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+
+	assert.Equal(t, queue.ErrQueueShutdown, w.QueueWithDelay(newJob(mockMessage{Message: "foo"}), time.Second))
+}
+
+func TestNSQQueueBatch(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_batch"),
+		WithMaxInFlight(10),
+	)
+	assert.NoError(t, err)
+
+	jobs := []core.QueuedMessage{
+		newJob(mockMessage{Message: "foo"}),
+		newJob(mockMessage{Message: "bar"}),
+		newJob(mockMessage{Message: "baz"}),
+	}
+	assert.NoError(t, w.QueueBatch(jobs))
+	assert.NoError(t, w.QueueBatch(nil))
+
+	var got []string
+	for range jobs {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		got = append(got, string(task.Bytes()))
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	assert.ElementsMatch(t, []string{"foo", "bar", "baz"}, got)
+	assert.NoError(t, w.Shutdown())
+
+	assert.Equal(t, queue.ErrQueueShutdown, w.QueueBatch(jobs))
+}
+
+func TestNSQQueueAsync(t *testing.T) {
+	results := make(chan error, 100)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_async"),
+		WithMaxInFlight(100),
+		WithPublishCallback(func(m core.QueuedMessage, err error) {
+			results <- err
+		}),
+	)
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, w.QueueAsync(newJob(mockMessage{Message: "foo"})))
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case err := <-results:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("publish not reported")
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.QueueAsync(newJob(mockMessage{Message: "foo"})))
+
+	l, err := net.Listen("tcp", host+":0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+
+	w, err = NewWorker(
+		WithAddr(addr),
+		WithTopic("queue_async"),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.QueueAsync(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQQueueAsyncRequeue(t *testing.T) {
+	results := make(chan error, 4)
+	var once sync.Once
+	var w *Worker
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_async_requeue"),
+		WithPublishCallback(func(m core.QueuedMessage, err error) {
+			results <- err
+			once.Do(func() {
+				// the result of the republish is received while Queue waits for nsqd
+				results <- w.QueueAsync(newJob(mockMessage{Message: "bar"}))
+				results <- w.Queue(newJob(mockMessage{Message: "baz"}))
+			})
+		}),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.QueueAsync(newJob(mockMessage{Message: "foo"})))
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-results:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("publish not reported")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQProducerAddr(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithProducerAddr(host+":4150"),
+		WithTopic("producer_addr"),
+	)
+	assert.NoError(t, err)
+
+	// the consumer reads from addr
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+
+	// the producer publishes to the producer addr
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "bar"})))
+	assert.Equal(t, 0, nsqd.count("PUB"))
+	assert.NoError(t, w.Shutdown())
+
+	c, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("producer_addr"),
+	)
+	assert.NoError(t, err)
+	task, err = c.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(task.Bytes()))
+	assert.NoError(t, c.Run(context.Background(), task))
+	assert.NoError(t, c.Shutdown())
+
+	_, err = NewWorker(
+		WithProducerAddr("invalid"),
+		WithTopic("producer_addr"),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQConsumerOnly(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	l, err := net.Listen("tcp", host+":0")
+	assert.NoError(t, err)
+	unreachable := l.Addr().String()
+	assert.NoError(t, l.Close())
+
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithProducerAddr(unreachable),
+		WithTopic("consumer_only"),
+		WithConsumerOnly(),
+	)
+	assert.NoError(t, err)
+	assert.Nil(t, w.p)
+
+	m := newJob(mockMessage{Message: "foo"})
+	assert.Equal(t, ErrProducerNotConfigured, w.Queue(m))
+	assert.Equal(t, ErrProducerNotConfigured, w.QueueAsync(m))
+	assert.Equal(t, ErrProducerNotConfigured, w.QueueWithDelay(m, time.Second))
+	assert.Equal(t, ErrProducerNotConfigured, w.QueueBatch([]core.QueuedMessage{m}))
+
+	nsqd.deliver("0000000000000001", m.Bytes(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithConsumerOnly(),
+		WithTopic("consumer_only"),
+		WithDeadLetterTopic("dead_letter"),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithConsumerOnly(),
+		WithTopic("consumer_only"),
+		WithProducerOnly(),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQProducerOnly(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("producer_only"),
+		WithProducerOnly(),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	_, err = w.Request()
+	assert.Equal(t, ErrConsumerNotConfigured, err)
+	assert.Nil(t, w.consumers())
+	assert.NoError(t, w.Shutdown())
+
+	c, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("producer_only"),
+		WithConsumerOnly(),
+	)
+	assert.NoError(t, err)
+	task, err := c.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, c.Run(context.Background(), task))
+	assert.NoError(t, c.Shutdown())
+}
+
+func TestNSQShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("shutdown_timeout"),
+		WithShutdownTimeout(200*time.Millisecond),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			close(started)
+			// ignore the canceled context
+			<-release
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background(), mockMessage{Message: "foo"})
+	}()
+	<-started
+
+	start := time.Now()
+	err = w.Shutdown()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "shutdown timed out")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	close(release)
+	assert.NoError(t, <-done)
+}
+
+func TestNSQShutdownContext(t *testing.T) {
+	started := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("shutdown_context"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, delegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background(), task)
+	}()
+	<-started
+
+	assert.NoError(t, w.ShutdownContext(context.Background()))
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, []time.Duration{-1}, delegate.requeued())
+	assert.Equal(t, queue.ErrQueueShutdown, w.ShutdownContext(context.Background()))
+}
+
+func TestNSQShutdownContextCanceled(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("shutdown_context"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- w.Run(context.Background(), mockMessage{Message: "foo"})
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.ShutdownContext(ctx))
+
+	close(release)
+	assert.NoError(t, <-done)
+}
+
+func TestNSQMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("metrics"),
+		WithMetrics(reg),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			switch string(m.Bytes()) {
+			case "panic":
+				panic("boom")
+			case "error":
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	for _, body := range []string{"foo", "bar", "error", "panic"} {
+		msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		_ = w.Run(context.Background(), task)
+	}
+
+	expected := `
+# HELP nsq_worker_jobs_failed_total Number of jobs which returned an error.
+# TYPE nsq_worker_jobs_failed_total counter
+nsq_worker_jobs_failed_total{channel="ch",topic="metrics"} 1
+# HELP nsq_worker_jobs_panicked_total Number of jobs which panicked.
+# TYPE nsq_worker_jobs_panicked_total counter
+nsq_worker_jobs_panicked_total{channel="ch",topic="metrics"} 1
+# HELP nsq_worker_jobs_processed_total Number of jobs processed successfully.
+# TYPE nsq_worker_jobs_processed_total counter
+nsq_worker_jobs_processed_total{channel="ch",topic="metrics"} 2
+# HELP nsq_worker_jobs_requeued_total Number of messages requeued to nsqd.
+# TYPE nsq_worker_jobs_requeued_total counter
+nsq_worker_jobs_requeued_total{channel="ch",topic="metrics"} 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"nsq_worker_jobs_processed_total",
+		"nsq_worker_jobs_failed_total",
+		"nsq_worker_jobs_panicked_total",
+		"nsq_worker_jobs_requeued_total",
+	))
+	count, err := testutil.GatherAndCount(reg, "nsq_worker_job_duration_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// workers with the same registerer share the collectors
+	w2, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("metrics"),
+		WithChannel("other"),
+		WithMetrics(reg),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Shutdown())
+	assert.NoError(t, w2.Shutdown())
+}
+
+func TestNSQTracer(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("tracer"),
+		WithTracer(tp),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			assert.True(t, trace.SpanContextFromContext(ctx).IsValid())
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	assert.NoError(t, w.QueueContext(ctx, newJob(mockMessage{Message: "foo"}, job.WithTimeout(time.Minute))))
+	parent.End()
+
+	// the mock keeps the failed message off the shared nsqd
+	bodies := nsqd.published()
+	assert.Len(t, bodies, 1)
+	nsqd.deliver("0000000000000001", bodies[0], 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.Error(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+
+	spans := sr.Ended()
+	assert.Len(t, spans, 3)
+	publish, process := spans[0], spans[2]
+	assert.Equal(t, "tracer publish", publish.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), publish.Parent().SpanID())
+	assert.Equal(t, "tracer process", process.Name())
+	assert.Equal(t, trace.SpanKindConsumer, process.SpanKind())
+	assert.Equal(t, publish.SpanContext().TraceID(), process.SpanContext().TraceID())
+	assert.Equal(t, publish.SpanContext().SpanID(), process.Parent().SpanID())
+	assert.Equal(t, codes.Error, process.Status().Code)
+	assert.Contains(t, process.Attributes(), attribute.Int("messaging.nsq.attempts", 1))
+	assert.Contains(t, process.Attributes(), attribute.String("job.timeout", time.Minute.String()))
+}
+
+func TestNSQQueueWithMetadata(t *testing.T) {
+	rets := make(chan map[string]string, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_with_metadata"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			rets <- MetadataFromContext(ctx)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	md := map[string]string{"correlation_id": "1234"}
+	assert.NoError(t, w.QueueWithMetadata(newJob(mockMessage{Message: "foo"}), md))
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, md, <-rets)
+
+	// jobs without metadata
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "bar"})))
+	task, err = w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Nil(t, <-rets)
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("queue_with_metadata"),
+		WithCodec(gobCodec{}),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.QueueWithMetadata(newJob(mockMessage{Message: "foo"}), md))
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMessageInfo(t *testing.T) {
+	rets := make(chan MessageInfo, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("message_info"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			info, ok := MessageInfoFromContext(ctx)
+			assert.True(t, ok)
+			rets <- info
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	msg.Attempts = 3
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(context.Background(), task))
+
+	info := <-rets
+	assert.Equal(t, msg.ID, info.ID)
+	assert.Equal(t, uint16(3), info.Attempts)
+	assert.Equal(t, msg.Timestamp, info.Timestamp.UnixNano())
+	assert.NoError(t, w.Shutdown())
+
+	_, ok := MessageInfoFromContext(context.Background())
+	assert.False(t, ok)
+}
+
+func TestNSQDialTimeout(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("dial_timeout"),
+		WithDialTimeout(3*time.Second),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, w.cfg.DialTimeout)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQReadWriteTimeout(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("read_write_timeout"),
+		WithReadTimeout(2*time.Minute),
+		WithWriteTimeout(500*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, w.cfg.ReadTimeout)
+	assert.Equal(t, 500*time.Millisecond, w.cfg.WriteTimeout)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("read_write_timeout"),
+		WithReadTimeout(10*time.Minute),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("read_write_timeout"),
+		WithWriteTimeout(10*time.Millisecond),
+	)
+	assert.Error(t, err)
+
+	// the heartbeat must come before the read timeout
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("read_write_timeout"),
+		WithReadTimeout(10*time.Second),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQSampleRate(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("sample_rate"),
+		WithSampleRate(10),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(10), w.cfg.SampleRate)
+	assert.NoError(t, w.Shutdown())
+
+	for _, rate := range []int32{-1, 100} {
+		_, err = NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic("sample_rate"),
+			WithSampleRate(rate),
+		)
+		assert.Error(t, err)
+	}
+}
+
+func TestNSQIdentity(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("identity"),
+		WithClientID("worker-1"),
+		WithHostname("worker-1.example.com"),
+		WithUserAgent("example/1.0"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker-1", w.cfg.ClientID)
+	assert.Equal(t, "worker-1.example.com", w.cfg.Hostname)
+	assert.Equal(t, "example/1.0", w.cfg.UserAgent)
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("identity"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, nsq.NewConfig().ClientID, w.cfg.ClientID)
+	assert.Equal(t, nsq.NewConfig().UserAgent, w.cfg.UserAgent)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQOutputBuffer(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("output_buffer"),
+		WithOutputBufferSize(4096),
+		WithOutputBufferTimeout(10*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4096), w.cfg.OutputBufferSize)
+	assert.Equal(t, 10*time.Millisecond, w.cfg.OutputBufferTimeout)
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("output_buffer"),
+		WithOutputBufferSize(-1),
+		WithOutputBufferTimeout(-1),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), w.cfg.OutputBufferSize)
+	assert.Equal(t, -time.Millisecond, w.cfg.OutputBufferTimeout)
+	assert.NoError(t, w.Shutdown())
+
+	for _, opt := range []Option{
+		WithOutputBufferSize(10),
+		WithOutputBufferTimeout(time.Microsecond),
+		WithOutputBufferTimeout(time.Minute),
+	} {
+		_, err = NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic("output_buffer"),
+			opt,
+		)
+		assert.Error(t, err)
+	}
+}
+
+func TestNSQConfig(t *testing.T) {
+	cfg := nsq.NewConfig()
+	cfg.MaxInFlight = 20
+	cfg.MaxAttempts = 10
+	cfg.LookupdPollInterval = 5 * time.Second
+	cfg.DialTimeout = 5 * time.Second
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("config"),
+		WithMaxInFlight(5),
+		WithConfig(cfg),
+		WithDialTimeout(2*time.Second),
+	)
+	assert.NoError(t, err)
+	// WithMaxInFlight is overridden by the config given after it
+	assert.Equal(t, 20, w.cfg.MaxInFlight)
+	assert.Equal(t, 20, w.Capacity())
+	assert.Equal(t, uint16(10), w.cfg.MaxAttempts)
+	assert.Equal(t, 5*time.Second, w.cfg.LookupdPollInterval)
+	assert.Equal(t, 2*time.Second, w.cfg.DialTimeout)
+	assert.NotSame(t, cfg, w.cfg)
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("config"),
+		WithConfig(cfg),
+		WithMaxInFlight(5),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, w.cfg.MaxInFlight)
+	assert.Equal(t, 20, cfg.MaxInFlight)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("config"),
+		WithConfig(&nsq.Config{}),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("config"),
+		WithConfig(nil),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQEphemeralChannel(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithProducerAddr(host+":4150"),
+		WithTopic("ephemeral_channel"),
+		WithChannel("monitor"),
+		WithEphemeralChannel(),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "monitor#ephemeral", w.opts.channel)
+
+	assert.NoError(t, w.startConsumer())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("SUB ephemeral_channel monitor#ephemeral") == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+
+	// the suffix isn't added twice
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("ephemeral_channel"),
+		WithChannel("monitor#ephemeral"),
+		WithEphemeralChannel(),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "monitor#ephemeral", w.opts.channel)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQPing(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("ping"),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.Ping())
+
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Ping())
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.Ping())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("ping"),
+		WithProducerOnly(),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Ping())
+	assert.NoError(t, w.Shutdown())
+
+	l, err := net.Listen("tcp", host+":0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	assert.NoError(t, l.Close())
+
+	w, err = NewWorker(
+		WithAddr(addr),
+		WithTopic("ping"),
+		WithProducerOnly(),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.Ping())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQStartConsumerOnce(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithProducerAddr(host+":4150"),
+		WithTopic("start_consumer_once"),
+	)
+	assert.NoError(t, err)
+
+	// Run handles a single job, the handler is only added by the first Request
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Run(context.Background(), task))
+
+	assert.Equal(t, 1, w.Stats().Connections)
+	assert.Equal(t, 1, nsqd.count("SUB"))
+	assert.NoError(t, w.Shutdown())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNSQShutdownBeforeRun(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("shutdown_before_run"),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.Run(context.Background(), newJob(mockMessage{Message: "foo"})))
+	_, err = w.Request()
+	assert.Equal(t, queue.ErrQueueShutdown, err)
+	assert.Nil(t, w.consumers())
+	assert.Equal(t, 0, w.Usage())
+}
+
+func TestNSQDropMessage(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("drop_message"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			if string(m.Bytes()) == "invalid" {
+				return fmt.Errorf("invalid payload: %w", ErrDrop)
+			}
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	dropped, droppedDelegate := newMockMessage(job.NewMessage(mockMessage{Message: "invalid"}, job.WithRetryCount(3)).Encode())
+	failed, failedDelegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: dropped, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: failed, sub: w.subs[0]}
+	}()
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, 1, droppedDelegate.finished())
+	assert.Empty(t, droppedDelegate.requeued())
+
+	task, err = w.Request()
+	assert.NoError(t, err)
+	assert.Error(t, w.Run(context.Background(), task))
+	assert.Equal(t, 0, failedDelegate.finished())
+	assert.Equal(t, []time.Duration{-1}, failedDelegate.requeued())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQLookupdPoll(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("lookupd_poll"),
+		WithLookupdPollInterval(5*time.Second),
+		WithLookupdPollJitter(0),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, w.cfg.LookupdPollInterval)
+	assert.Equal(t, float64(0), w.cfg.LookupdPollJitter)
+	assert.NoError(t, w.Shutdown())
+
+	for _, opt := range []Option{
+		WithLookupdPollInterval(time.Millisecond),
+		WithLookupdPollInterval(time.Hour),
+		WithLookupdPollJitter(-0.1),
+		WithLookupdPollJitter(1.5),
+	} {
+		_, err = NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic("lookupd_poll"),
+			opt,
+		)
+		assert.Error(t, err)
+	}
+}
+
+func TestNSQRDYRedistribute(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("rdy_redistribute"),
+		WithLowRdyIdleTimeout(2*time.Second),
+		WithRDYRedistributeInterval(500*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, w.cfg.LowRdyIdleTimeout)
+	assert.Equal(t, 500*time.Millisecond, w.cfg.RDYRedistributeInterval)
+	assert.NoError(t, w.Shutdown())
+
+	for _, opt := range []Option{
+		WithLowRdyIdleTimeout(100 * time.Millisecond),
+		WithRDYRedistributeInterval(10 * time.Second),
+	} {
+		_, err = NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic("rdy_redistribute"),
+			opt,
+		)
+		assert.Error(t, err)
+	}
+}
+
+func TestNSQDefaultTimeout(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("default_timeout"),
+		WithDefaultTimeout(time.Minute),
+	)
+	assert.NoError(t, err)
+
+	// a message published without timeout
+	external, _ := newMockMessage([]byte(`{"body":"Zm9v"}`))
+	withTimeout, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}, job.WithTimeout(time.Second)).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: external, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: withTimeout, sub: w.subs[0]}
+	}()
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.Equal(t, time.Minute, task.(*job.Message).Timeout)
+	assert.NoError(t, w.Run(context.Background(), task))
+
+	task, err = w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, task.(*job.Message).Timeout)
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("default_timeout"),
+		WithDefaultTimeout(0),
+	)
+	assert.Error(t, err)
+}
+
+type tenantKey struct{}
+
+func TestNSQBaseContext(t *testing.T) {
+	type result struct {
+		tenant   interface{}
+		deadline time.Time
+	}
+	rets := make(chan result, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("base_context"),
+		WithBaseContext(func() context.Context {
+			return context.WithValue(context.Background(), tenantKey{}, "acme")
+		}),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			deadline, _ := ctx.Deadline()
+			rets <- result{tenant: ctx.Value(tenantKey{}), deadline: deadline}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx, task))
+	ret := <-rets
+	assert.Equal(t, "acme", ret.tenant)
+	assert.Equal(t, deadline, ret.deadline)
+
+	assert.NoError(t, w.Run(ctx, mockMessage{Message: "bar"}))
+	assert.Equal(t, "acme", (<-rets).tenant)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{}, 2)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("context"),
+		WithContext(ctx),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	)
+	assert.NoError(t, err)
+
+	errs := make(chan error, 2)
+	for _, body := range []string{"foo", "bar"} {
+		m := mockMessage{Message: body}
+		go func() {
+			errs <- w.Run(context.Background(), m)
+		}()
+	}
+	<-started
+	<-started
+
+	// canceling the worker context cancels every running job
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.Equal(t, context.Canceled, <-errs)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) func(RunFunc) RunFunc {
+		return func(next RunFunc) RunFunc {
+			return func(ctx context.Context, m core.QueuedMessage) error {
+				calls = append(calls, name+" before "+string(m.Bytes()))
+				err := next(ctx, m)
+				calls = append(calls, fmt.Sprintf("%s after %v", name, err))
+				return err
+			}
+		}
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("middleware"),
+		WithMiddleware(trace("first"), trace("second")),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			calls = append(calls, "run")
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	assert.Error(t, w.Run(context.Background(), mockMessage{Message: "foo"}))
+	assert.Equal(t, []string{
+		"first before foo",
+		"second before foo",
+		"run",
+		"second after failed",
+		"first after failed",
+	}, calls)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQLogFailure(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("log_failure"),
+		WithLogger(logger),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	msg.Attempts = 2
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Error(t, w.Run(context.Background(), task))
+	assert.Equal(t, []string{
+		"job failed on topic log_failure channel ch, message 0123456789abcdef attempt 2: failed",
+	}, logger.logged())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQRecoverPanic(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("recover_panic"),
+		WithLogger(logger),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			if string(m.Bytes()) == "panic" {
+				panic("boom")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	panicked, panickedDelegate := newMockMessage(job.NewMessage(mockMessage{Message: "panic"}).Encode())
+	next, nextDelegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: panicked, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: next, sub: w.subs[0]}
+	}()
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.NotPanics(t, func() {
+		assert.EqualError(t, w.Run(context.Background(), task), "panic: boom")
+	})
+	assert.Equal(t, []time.Duration{-1}, panickedDelegate.requeued())
+	assert.Len(t, logger.logged(), 1)
+	assert.Contains(t, logger.logged()[0], "panic: boom")
+	assert.Equal(t, 0, w.Usage())
+
+	task, err = w.Request()
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, 1, nextDelegate.finished())
+	assert.NoError(t, w.Shutdown())
+}
+
+func panickingHandler(ctx context.Context, m core.QueuedMessage) error {
+	panic("boom")
+}
+
+func TestNSQPanicStack(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("panic_stack"),
+		WithLogger(logger),
+		WithRunFunc(panickingHandler),
+	)
+	assert.NoError(t, err)
+
+	err = w.Run(context.Background(), mockMessage{Message: "foo"})
+	var pe *PanicError
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, "boom", pe.Value)
+	assert.Contains(t, string(pe.Stack), "nsq.panickingHandler")
+
+	assert.Len(t, logger.logged(), 1)
+	assert.Contains(t, logger.logged()[0], "panic: boom")
+	assert.Contains(t, logger.logged()[0], "nsq.panickingHandler")
+	assert.Contains(t, logger.logged()[0], "nsq_test.go")
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQErrorHandler(t *testing.T) {
+	type failure struct {
+		job core.QueuedMessage
+		err error
+	}
+	var failures []failure
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("error_handler"),
+		WithLogger(queue.NewEmptyLogger()),
+		WithErrorHandler(func(m core.QueuedMessage, err error) {
+			failures = append(failures, failure{job: m, err: err})
+		}),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			switch string(m.Bytes()) {
+			case "panic":
+				panic("boom")
+			case "error":
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	ok := mockMessage{Message: "ok"}
+	failed := mockMessage{Message: "error"}
+	panicked := mockMessage{Message: "panic"}
+	assert.NoError(t, w.Run(context.Background(), ok))
+	assert.Error(t, w.Run(context.Background(), failed))
+	assert.Error(t, w.Run(context.Background(), panicked))
+
+	assert.Len(t, failures, 2)
+	assert.Equal(t, failed, failures[0].job)
+	assert.EqualError(t, failures[0].err, "failed")
+	assert.Equal(t, panicked, failures[1].job)
+	var pe *PanicError
+	assert.True(t, errors.As(failures[1].err, &pe))
+	assert.Equal(t, "boom", pe.Value)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQSuccessHandler(t *testing.T) {
+	var durations []time.Duration
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("success_handler"),
+		WithLogger(queue.NewEmptyLogger()),
+		WithSuccessHandler(func(m core.QueuedMessage, d time.Duration) {
+			assert.Equal(t, "ok", string(m.Bytes()))
+			durations = append(durations, d)
+		}),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			if string(m.Bytes()) == "error" {
+				return errors.New("failed")
+			}
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	assert.NoError(t, w.Run(context.Background(), mockMessage{Message: "ok"}))
+	assert.Error(t, w.Run(context.Background(), mockMessage{Message: "error"}))
+	assert.NoError(t, w.Run(context.Background(), mockMessage{Message: "ok"}))
+
+	assert.Len(t, durations, 2)
+	for _, d := range durations {
+		assert.GreaterOrEqual(t, d, 50*time.Millisecond)
+		assert.Less(t, d, time.Second)
+	}
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQPauseResume(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("pause_resume"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrConsumerNotStarted, w.Pause())
+	assert.Equal(t, ErrConsumerNotStarted, w.Resume())
+
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Pause())
+	assert.NoError(t, w.Pause())
+	time.Sleep(50 * time.Millisecond)
+
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, uint64(0), w.Stats().MessagesReceived)
+
+	assert.NoError(t, w.Resume())
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, uint64(1), w.Stats().MessagesReceived)
+
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.Pause())
+}
+
+func TestNSQSetMaxInFlight(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("set_max_in_flight"),
+		WithMaxInFlight(1),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrConsumerNotStarted, w.SetMaxInFlight(3))
+	assert.Error(t, w.SetMaxInFlight(0))
+
+	assert.NoError(t, w.startConsumer())
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	}
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, uint64(1), w.Stats().MessagesReceived)
+
+	assert.NoError(t, w.SetMaxInFlight(3))
+	assert.Equal(t, 3, w.Capacity())
+
+	// the three messages are in flight together before any of them is run
+	tasks := make([]core.QueuedMessage, 0, 3)
+	for i := 0; i < 3; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks {
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQLogger(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("logger"),
+		WithLogger(logger),
+		WithNSQLogLevel(nsq.LogLevelInfo),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Shutdown())
+
+	connected := 0
+	for _, line := range logger.informed() {
+		if strings.HasPrefix(line, "INF") && strings.Contains(line, "connecting to nsqd") {
+			connected++
+		}
+	}
+	// both the producer and the consumer connect
+	assert.Equal(t, 2, connected)
+
+	logger = &mockLogger{}
+	l := nsqLogger{logger: logger}
+	assert.NoError(t, l.Output(2, "INF    1 [logger/ch] (127.0.0.1:4150) info"))
+	assert.NoError(t, l.Output(2, "WRN    1 [logger/ch] (127.0.0.1:4150) warning"))
+	assert.NoError(t, l.Output(2, "ERR    1 [logger/ch] (127.0.0.1:4150) error"))
+	assert.Equal(t, []string{
+		"INF    1 [logger/ch] (127.0.0.1:4150) info",
+		"WRN    1 [logger/ch] (127.0.0.1:4150) warning",
+	}, logger.informed())
+	assert.Equal(t, []string{"ERR    1 [logger/ch] (127.0.0.1:4150) error"}, logger.logged())
+}
+
+func TestNSQLogLevel(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("log_level"),
+		WithLogger(logger),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, nsq.LogLevelWarning, w.opts.nsqLogLevel)
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.Restart())
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Shutdown())
+
+	// the info lines are below the default level
+	for _, line := range logger.informed() {
+		assert.False(t, strings.HasPrefix(line, "INF"), line)
+	}
+	// the warnings of a graceful shutdown aren't errors
+	for _, line := range logger.logged() {
+		assert.False(t, strings.HasPrefix(line, "WRN"), line)
+	}
+	// the default channel is reported once, not on every restart
+	fallback := 0
+	for _, line := range logger.informed() {
+		if line == `no channel set, consuming topic log_level from the "ch" channel` {
+			fallback++
+		}
+	}
+	assert.Equal(t, 1, fallback)
+
+	logger = &mockLogger{}
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("log_level"),
+		WithLogger(logger),
+		WithNSQLogLevel(nsq.LogLevelDebug),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+	assert.NoError(t, w.Shutdown())
+
+	debug := false
+	for _, line := range logger.informed() {
+		debug = debug || strings.HasPrefix(line, "DBG")
+	}
+	assert.True(t, debug)
+}
+
+func TestNSQTopics(t *testing.T) {
+	var mu sync.Mutex
+	got := []string{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topics_a"),
+		WithTopics([]TopicChannel{{Topic: "topics_b", Channel: "fan_in"}}),
+		WithMaxInFlight(2),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			mu.Lock()
+			got = append(got, string(m.Bytes()))
+			mu.Unlock()
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, w.Capacity())
+
+	p, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topics_b"),
+		WithProducerOnly(),
+	)
+	assert.NoError(t, err)
+
+	q, err := queue.NewQueue(
+		queue.WithWorker(w),
+		queue.WithWorkerCount(2),
+	)
+	assert.NoError(t, err)
+	q.Start()
+	assert.NoError(t, q.Queue(mockMessage{Message: "foo"}))
+	assert.NoError(t, p.Queue(newJob(mockMessage{Message: "bar"})))
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"foo", "bar"}, got)
+	assert.Equal(t, uint64(2), w.Stats().MessagesFinished)
+	assert.Equal(t, 2, w.Stats().Connections)
+
+	q.Release()
+	assert.NoError(t, p.Shutdown())
+}
+
+func TestNSQTopicsNames(t *testing.T) {
+	_, err := NewWorker(
+		WithTopic("topics"),
+		WithTopics([]TopicChannel{{Topic: "topics"}}),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithTopic("topics"),
+		WithTopics([]TopicChannel{{Topic: "bad topic"}}),
+	)
+	assert.Error(t, err)
+
+	_, err = NewWorker(
+		WithTopic("topics"),
+		WithTopics([]TopicChannel{{Topic: "other"}}),
+		WithProducerOnly(),
+	)
+	assert.Error(t, err)
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topics"),
+		WithTopics([]TopicChannel{{Topic: "topics", Channel: "other"}}),
+		WithEphemeralChannel(),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "ch#ephemeral", w.subs[0].channel)
+	assert.Equal(t, "other#ephemeral", w.subs[1].channel)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQTopicHandler(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	handler := func(name string) func(context.Context, core.QueuedMessage) error {
+		return func(ctx context.Context, m core.QueuedMessage) error {
+			mu.Lock()
+			got[name] = append(got[name], string(m.Bytes()))
+			mu.Unlock()
+			return nil
+		}
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topic_handler_a"),
+		WithRunFunc(handler("a")),
+		WithTopicHandler("topic_handler_b", "", handler("b")),
+		WithTopicHandler("topic_handler_c", "other", handler("c")),
+		WithMiddleware(func(next RunFunc) RunFunc {
+			return func(ctx context.Context, m core.QueuedMessage) error {
+				mu.Lock()
+				got["middleware"] = append(got["middleware"], string(m.Bytes()))
+				mu.Unlock()
+				return next(ctx, m)
+			}
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "ch", w.subs[1].channel)
+	assert.Equal(t, "other", w.subs[2].channel)
+
+	q, err := queue.NewQueue(
+		queue.WithWorker(w),
+		queue.WithWorkerCount(3),
+	)
+	assert.NoError(t, err)
+	q.Start()
+	assert.NoError(t, q.Queue(mockMessage{Message: "foo"}))
+	for _, topic := range []string{"topic_handler_b", "topic_handler_c"} {
+		p, err := NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic(topic),
+			WithProducerOnly(),
+		)
+		assert.NoError(t, err)
+		assert.NoError(t, p.Queue(newJob(mockMessage{Message: topic})))
+		assert.NoError(t, p.Shutdown())
+	}
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got["middleware"]) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	q.Release()
+
+	assert.Equal(t, []string{"foo"}, got["a"])
+	assert.Equal(t, []string{"topic_handler_b"}, got["b"])
+	assert.Equal(t, []string{"topic_handler_c"}, got["c"])
+	for _, sub := range w.subs {
+		assert.Equal(t, 0, sub.q.Stats().Connections)
+	}
+}
+
+func TestNSQBatchSize(t *testing.T) {
+	batches := make(chan []string, 2)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("batch_size"),
+		WithBatch(3, time.Hour, func(ctx context.Context, jobs []core.QueuedMessage) error {
+			bodies := []string{}
+			for _, m := range jobs {
+				bodies = append(bodies, string(m.Bytes()))
+			}
+			batches <- bodies
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	delegates := []*mockDelegate{}
+	for _, body := range []string{"foo", "bar", "baz"} {
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		delegates = append(delegates, d)
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.Run(context.Background(), task))
+		}()
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []string{"foo", "bar", "baz"}, <-batches)
+	assert.Len(t, batches, 0)
+	for _, d := range delegates {
+		assert.Equal(t, 1, d.finished())
+	}
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQBatchFlush(t *testing.T) {
+	batches := make(chan int, 2)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("batch_flush"),
+		WithBatch(10, 100*time.Millisecond, func(ctx context.Context, jobs []core.QueuedMessage) error {
+			batches <- len(jobs)
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	delegates := []*mockDelegate{}
+	for _, body := range []string{"foo", "bar"} {
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		delegates = append(delegates, d)
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		task, err := w.Request()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.EqualError(t, w.Run(context.Background(), task), "failed")
+		}()
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, 2, <-batches)
+	for _, d := range delegates {
+		assert.Equal(t, 0, d.finished())
+		assert.Len(t, d.requeued(), 1)
+	}
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithTopic("batch_flush"),
+		WithBatch(0, time.Second, func(ctx context.Context, jobs []core.QueuedMessage) error {
+			return nil
+		}),
+	)
+	assert.Error(t, err)
+	_, err = NewWorker(
+		WithTopic("batch_flush"),
+		WithBatch(1, 0, func(ctx context.Context, jobs []core.QueuedMessage) error {
+			return nil
+		}),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQPublishObserver(t *testing.T) {
+	var mu sync.Mutex
+	durations := []time.Duration{}
+	errs := []error{}
+	observer := func(d time.Duration, err error) {
+		mu.Lock()
+		durations = append(durations, d)
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("publish_observer"),
+		WithProducerOnly(),
+		WithPublishObserver(observer),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "bar"})))
+	assert.NoError(t, w.QueueWithDelay(newJob(mockMessage{Message: "baz"}), time.Second))
+	assert.NoError(t, w.QueueBatch([]core.QueuedMessage{newJob(mockMessage{Message: "qux"})}))
+	assert.NoError(t, w.Shutdown())
+
+	assert.Len(t, durations, 4)
+	for i, d := range durations {
+		assert.Greater(t, d, time.Duration(0))
+		assert.NoError(t, errs[i])
+	}
+
+	durations, errs = nil, nil
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithProducerAddr(host+":1"),
+		WithTopic("publish_observer"),
+		WithProducerOnly(),
+		WithPublishObserver(observer),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.Shutdown())
+	assert.Len(t, durations, 1)
+	assert.Error(t, errs[0])
+}
+
+func TestNSQConnectionListener(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	events := make(chan ConnEvent, 10)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("connection_listener"),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithConnectionListener(func(event ConnEvent) {
+			events <- event
+		}),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+
+	event := <-events
+	assert.Equal(t, ConnConnected, event.Type)
+	assert.Equal(t, "connection_listener", event.Topic)
+	assert.Equal(t, "ch", event.Channel)
+	assert.Equal(t, 1, event.Connections)
+
+	// nsqd going away closes the connection
+	nsqd.Close()
+	event = <-events
+	assert.Equal(t, ConnDisconnected, event.Type)
+	assert.Equal(t, 0, event.Connections)
+	assert.NoError(t, w.Shutdown())
+	assert.Len(t, events, 0)
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(host+":1"),
+		WithTopic("connection_listener"),
+		WithConnectionListener(func(event ConnEvent) {
+			events <- event
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.startConsumer())
+	event = <-events
+	assert.Equal(t, ConnError, event.Type)
+	assert.Error(t, event.Err)
+	assert.Equal(t, "error", event.Type.String())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQInjectedProducer(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	p, err := nsq.NewProducer(nsqd.Addr(), nsq.NewConfig())
+	assert.NoError(t, err)
+
+	w, err := NewWorker(
+		WithTopic("injected_producer"),
+		WithProducer(p),
+		WithProducerOnly(),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, p, w.p)
+
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	assert.Equal(t, 1, nsqd.count("PUB"))
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, nsq.ErrStopped, p.Publish("injected_producer", []byte("foo")))
+
+	_, err = NewWorker(
+		WithTopic("injected_producer"),
+		WithProducer(p),
+		WithConsumerOnly(),
+	)
+	assert.Error(t, err)
+	_, err = NewWorker(
+		WithTopic("injected_producer"),
+		WithProducer(nil),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQInjectedConsumer(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	q, err := nsq.NewConsumer("injected_consumer", "ch", nsq.NewConfig())
+	assert.NoError(t, err)
+
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("injected_consumer"),
+		WithConsumer(q),
+		WithConsumerOnly(),
+	)
+	assert.NoError(t, err)
+
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, []*nsq.Consumer{q}, w.consumers())
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, w.Shutdown())
+	<-q.StopChan
+
+	_, err = NewWorker(
+		WithTopic("injected_consumer"),
+		WithConsumer(q),
+		WithProducerOnly(),
+	)
+	assert.Error(t, err)
+}
+
+func TestExecute(t *testing.T) {
+	waitDone := func(ctx context.Context, m core.QueuedMessage) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name    string
+		run     RunFunc
+		timeout time.Duration
+		stop    bool
+		want    error
+	}{
+		{
+			name: "completed",
+			run: func(ctx context.Context, m core.QueuedMessage) error {
+				return nil
+			},
+		},
+		{
+			name: "failed",
+			run: func(ctx context.Context, m core.QueuedMessage) error {
+				return errors.New("failed")
+			},
+			want: errors.New("failed"),
+		},
+		{
+			name:    "timeout",
+			run:     waitDone,
+			timeout: 50 * time.Millisecond,
+			want:    context.DeadlineExceeded,
+		},
+		{
+			name: "stopped",
+			run:  waitDone,
+			stop: true,
+			want: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			stop := make(chan struct{})
+			if tt.stop {
+				time.AfterFunc(50*time.Millisecond, func() {
+					close(stop)
+				})
+			}
+
+			err := execute(ctx, tt.run, newJob(mockMessage{Message: "foo"}), stop)
+			assert.Equal(t, tt.want, err)
+		})
+	}
+
+	t.Run("panicked", func(t *testing.T) {
+		err := execute(context.Background(), func(ctx context.Context, m core.QueuedMessage) error {
+			panic("missing something")
+		}, newJob(mockMessage{Message: "foo"}), make(chan struct{}))
+
+		var pe *PanicError
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "missing something", pe.Value)
+		assert.Contains(t, string(pe.Stack), "TestExecute")
+	})
+}
+
+func TestNSQQueueFullPolicy(t *testing.T) {
+	// reserve a free port, nsqd starts on it after the first publish failed
+	nsqd := newMockNSQD(t, host+":0")
+	addr := nsqd.Addr()
+	nsqd.Close()
+
+	newProducer := func(opts ...Option) *Worker {
+		w, err := NewWorker(append([]Option{
+			WithAddr(addr),
+			WithTopic("queue_full_policy"),
+			WithProducerOnly(),
+		}, opts...)...)
+		assert.NoError(t, err)
+		return w
+	}
+	m := newJob(mockMessage{Message: "foo"})
+
+	w := newProducer()
+	assert.Error(t, w.Queue(m))
+	assert.NoError(t, w.Shutdown())
+
+	w = newProducer(
+		WithQueueFullPolicy(RetryOnQueueFull),
+		WithPublishRetry(3, 20*time.Millisecond),
+	)
+	start := time.Now()
+	assert.Error(t, w.Queue(m))
+	// 20ms and 40ms between the attempts
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	assert.NoError(t, w.Shutdown())
+
+	w = newProducer(
+		WithQueueFullPolicy(RetryOnQueueFull),
+		WithPublishRetry(5, 20*time.Millisecond),
+	)
+	restarted := make(chan *mockNSQD)
+	time.AfterFunc(50*time.Millisecond, func() {
+		restarted <- newMockNSQD(t, addr)
+	})
+	assert.NoError(t, w.Queue(m))
+	nsqd = <-restarted
+	assert.Equal(t, 1, nsqd.count("PUB"))
+	assert.NoError(t, w.Shutdown())
+	nsqd.Close()
+
+	w = newProducer(
+		WithQueueFullPolicy(BlockOnQueueFull),
+		WithPublishRetry(1, 20*time.Millisecond),
+		WithPublishTimeout(200*time.Millisecond),
+	)
+	start = time.Now()
+	err := w.Queue(m)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "publish not acknowledged within 200ms")
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		restarted <- newMockNSQD(t, addr)
+	})
+	assert.NoError(t, w.Queue(m))
+	nsqd = <-restarted
+	assert.Equal(t, 1, nsqd.count("PUB"))
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithTopic("queue_full_policy"),
+		WithPublishRetry(0, time.Second),
+	)
+	assert.Error(t, err)
+	_, err = NewWorker(
+		WithTopic("queue_full_policy"),
+		WithPublishTimeout(0),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQPublishTimeoutStalled(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(newStalledNSQD(t)),
+		WithTopic("publish_timeout_stalled"),
+		WithProducerOnly(),
+		WithQueueFullPolicy(BlockOnQueueFull),
+		WithPublishTimeout(100*time.Millisecond),
+		// the abandoned handshake fails before the shutdown stops the producer
+		WithHeartbeatInterval(100*time.Millisecond),
+		WithReadTimeout(500*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	// nsqd accepts the connection but never answers the handshake
+	start := time.Now()
+	err = w.Queue(newJob(mockMessage{Message: "foo"}))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "publish not acknowledged within 100ms")
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQDeduplication(t *testing.T) {
+	runs := 0
+	fail := true
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("deduplication"),
+		WithDeduplication(NewMemoryDedupeStore(), time.Minute),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			runs++
+			if fail {
+				fail = false
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	run := func() *mockDelegate {
+		// every mock message has the same ID
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		_ = w.Run(context.Background(), task)
+		return d
+	}
+
+	// a failed job isn't recorded, its message is run again
+	d := run()
+	assert.Len(t, d.requeued(), 1)
+	d = run()
+	assert.Equal(t, 1, d.finished())
+	assert.Equal(t, 2, runs)
+
+	// the duplicate is finished without running the job
+	d = run()
+	assert.Equal(t, 1, d.finished())
+	assert.Equal(t, 2, runs)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithTopic("deduplication"),
+		WithDeduplication(nil, time.Minute),
+	)
+	assert.Error(t, err)
+}
+
+func TestMemoryDedupeStore(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryDedupeStore()
+	s.now = func() time.Time {
+		return now
+	}
+
+	seen, err := s.Seen("foo")
+	assert.NoError(t, err)
+	assert.False(t, seen)
+
+	assert.NoError(t, s.Record("foo", time.Minute))
+	seen, _ = s.Seen("foo")
+	assert.True(t, seen)
+
+	now = now.Add(30 * time.Second)
+	assert.NoError(t, s.Record("bar", time.Minute))
+	now = now.Add(30 * time.Second)
+	seen, _ = s.Seen("foo")
+	assert.False(t, seen)
+	seen, _ = s.Seen("bar")
+	assert.True(t, seen)
+
+	// the expired IDs are swept by Record
+	assert.NoError(t, s.Record("baz", time.Minute))
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, s.Record("qux", time.Minute))
+	assert.Len(t, s.expires, 1)
+}
+
+func TestNSQEmptyBodyHandler(t *testing.T) {
+	errKeepalive := errors.New("unexpected keepalive")
+	got := make(chan *nsq.Message, 1)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("empty_body_handler"),
+		WithEmptyBodyHandler(func(msg *nsq.Message) error {
+			got <- msg
+			return errKeepalive
+		}),
+	)
+	assert.NoError(t, err)
+
+	h := &messageHandler{w: w, sub: w.subs[0]}
+	empty, _ := newMockMessage(nil)
+	assert.Equal(t, errKeepalive, h.HandleMessage(empty))
+	assert.Equal(t, empty, <-got)
+	assert.NoError(t, w.Shutdown())
+
+	// empty bodies are discarded by default
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("empty_body_handler"),
+	)
+	assert.NoError(t, err)
+	h = &messageHandler{w: w, sub: w.subs[0]}
+	assert.NoError(t, h.HandleMessage(empty))
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMaxInFlightPerConn(t *testing.T) {
+	nsqd1 := newMockNSQD(t, host+":0")
+	nsqd2 := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd1.Addr(), nsqd2.Addr()),
+		WithTopic("max_in_flight_per_conn"),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithMaxInFlight(10),
+		WithMaxInFlightPerConn(2),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+
+	// each connection is capped to 2 instead of 10 / 2
+	assert.Eventually(t, func() bool {
+		return nsqd1.last("RDY") == "RDY 2" && nsqd2.last("RDY") == "RDY 2"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a resumed consumer keeps the cap
+	assert.NoError(t, w.Pause())
+	assert.Eventually(t, func() bool {
+		return nsqd1.last("RDY") == "RDY 0" && nsqd2.last("RDY") == "RDY 0"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Resume())
+	assert.Eventually(t, func() bool {
+		return nsqd1.last("RDY") == "RDY 2" && nsqd2.last("RDY") == "RDY 2"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("max_in_flight_per_conn"),
+		WithMaxInFlightPerConn(0),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQShutdownFlushesPublishes(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	results := make(chan error, 1)
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("shutdown_flush"),
+		WithProducerOnly(),
+		WithPublishCallback(func(m core.QueuedMessage, err error) {
+			results <- err
+		}),
+	)
+	assert.NoError(t, err)
+
+	// the publish is still pending when the worker is shutdown
+	assert.NoError(t, w.QueueAsync(newJob(mockMessage{Message: "foo"})))
+	assert.NoError(t, w.Shutdown())
+	assert.NoError(t, <-results)
+	assert.Equal(t, 1, nsqd.count("PUB"))
+	assert.Equal(t, queue.ErrQueueShutdown, w.beginPublish())
+}
+
+func TestNSQRequeueDelay(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("requeue_delay"),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithBackoffDisabled(),
+		WithDefaultRequeueDelay(time.Second),
+		WithMaxRequeueDelay(1500*time.Millisecond),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, w.cfg.DefaultRequeueDelay)
+	assert.Equal(t, 1500*time.Millisecond, w.cfg.MaxRequeueDelay)
+
+	// the default delay grows with the attempts up to the max delay
+	for attempts, want := range map[uint16]string{1: "1000", 2: "1500"} {
+		nsqd.deliver("0123456789abcdef", job.NewMessage(mockMessage{Message: "foo"}).Encode(), attempts)
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.Error(t, w.Run(context.Background(), task))
+		assert.Eventually(t, func() bool {
+			return nsqd.last("REQ") == "REQ 0123456789abcdef "+want
+		}, time.Second, 10*time.Millisecond)
+	}
+	assert.NoError(t, w.Shutdown())
+
+	// the max delay bounds the RequeueError delays too
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("requeue_delay"),
+		WithMaxRequeueDelay(1500*time.Millisecond),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return RequeueError{Delay: time.Minute}
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, delegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Error(t, w.Run(context.Background(), task))
+	assert.Equal(t, []time.Duration{1500 * time.Millisecond}, delegate.requeued())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQTopicCreate(t *testing.T) {
+	var mu sync.Mutex
+	var created []string
+	nsqd := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/topic/create", r.URL.Path)
+		topic := r.URL.Query().Get("topic")
+		if topic == "forbidden" {
+			http.Error(rw, "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		created = append(created, topic)
+		mu.Unlock()
+	}))
+	defer nsqd.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topic_create"),
+		WithDeadLetterTopic("topic_create_dlq"),
+		WithTopicCreate(nsqd.Listener.Addr().String()),
+	)
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"topic_create", "topic_create_dlq"}, created)
+	mu.Unlock()
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("forbidden"),
+		WithTopicCreate(nsqd.URL),
+	)
+	assert.EqualError(t, err, "could not create topic forbidden: nsqd /topic/create returned 403 Forbidden: FORBIDDEN")
+}
+
+func TestNSQChannelCreate(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	created := make(chan string, 2)
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/channel/create", r.URL.Path)
+		// the channel exists before the consumer subscribes
+		assert.Equal(t, 0, nsqd.count("SUB"))
+		created <- r.URL.Query().Get("topic") + "/" + r.URL.Query().Get("channel")
+	}))
+	defer api.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("channel_create"),
+		WithChannel("a"),
+		WithTopics([]TopicChannel{{Topic: "channel_create", Channel: "b"}}),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithChannelCreate(api.Listener.Addr().String()),
+	)
+	assert.NoError(t, err)
+	assert.Len(t, created, 0)
+	assert.NoError(t, w.startConsumer())
+	assert.Equal(t, "channel_create/a", <-created)
+	assert.Equal(t, "channel_create/b", <-created)
+	assert.Eventually(t, func() bool {
+		return nsqd.count("SUB") == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("channel_create"),
+		WithChannelCreate(host+":1"),
+	)
+	assert.NoError(t, err)
+	assert.Error(t, w.startConsumer())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQInFlight(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("in_flight"),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithMaxInFlight(2),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, w.InFlight())
+
+	assert.NoError(t, w.startConsumer())
+	body := job.NewMessage(mockMessage{Message: "foo"}).Encode()
+	nsqd.deliver("0123456789abcde1", body, 1)
+	nsqd.deliver("0123456789abcde2", body, 1)
+	task1, err := w.Request()
+	assert.NoError(t, err)
+	task2, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, w.InFlight())
+
+	assert.NoError(t, w.Run(context.Background(), task1))
+	assert.Eventually(t, func() bool {
+		return w.InFlight() == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Run(context.Background(), task2))
+	assert.Eventually(t, func() bool {
+		return w.InFlight() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQStartupJitter(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("startup_jitter"),
+		WithStartupJitter(200*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	// a seeded source draws the same delays
+	w.rand = rand.New(rand.NewSource(1))
+	seeded := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		d := w.startupDelay()
+		assert.Equal(t, time.Duration(seeded.Int63n(int64(200*time.Millisecond)+1)), d)
+		assert.True(t, d >= 0 && d <= 200*time.Millisecond)
+	}
+
+	w.rand = rand.New(rand.NewSource(1))
+	delay := rand.New(rand.NewSource(1)).Int63n(int64(200*time.Millisecond) + 1)
+	start := time.Now()
+	assert.NoError(t, w.startConsumer())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), delay)
+	assert.NoError(t, w.Shutdown())
+
+	// shutdown interrupts the jitter
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("startup_jitter"),
+		WithStartupJitter(time.Hour),
+	)
+	assert.NoError(t, err)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.startConsumer()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, <-errs)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("startup_jitter"),
+		WithStartupJitter(-time.Second),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQConcurrencyLimit(t *testing.T) {
+	var running, peak int32
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("concurrency_limit"),
+		WithMaxInFlight(10),
+		WithConcurrencyLimit(2),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.Run(context.Background(), task))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("concurrency_limit"),
+		WithConcurrencyLimit(0),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQRateLimit(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("rate_limit"),
+		WithMaxInFlight(10),
+		WithRateLimit(20, 1),
+	)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.NoError(t, w.Run(context.Background(), task))
+	}
+	// the first job starts right away, the next ones every 50ms
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(9*50*time.Millisecond))
+
+	assert.NoError(t, w.Shutdown())
+
+	// shutdown interrupts the jobs waiting for the limiter
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("rate_limit"),
+		WithMaxInFlight(10),
+		WithRateLimit(1, 1),
+	)
+	assert.NoError(t, err)
+	var delegate *mockDelegate
+	tasks := make([]core.QueuedMessage, 2)
+	for i := range tasks {
+		var msg *nsq.Message
+		msg, delegate = newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		tasks[i], err = w.Request()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Run(context.Background(), tasks[0]))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.Run(context.Background(), tasks[1])
+	}()
+	assert.Eventually(t, func() bool {
+		return w.Usage() == 1
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	assert.Len(t, delegate.requeued(), 1)
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("rate_limit"),
+		WithRateLimit(10, 0),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQTopicRateLimit(t *testing.T) {
+	noop := func(ctx context.Context, m core.QueuedMessage) error {
+		return nil
+	}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topic_rate_limit_fast"),
+		WithTopicHandler("topic_rate_limit_slow", "ch", noop),
+		WithMaxInFlight(10),
+		WithTopicRateLimit("topic_rate_limit_fast", 50, 1),
+		WithTopicRateLimit("topic_rate_limit_slow", 10, 1),
+	)
+	assert.NoError(t, err)
+
+	tasks := make(map[string][]core.QueuedMessage)
+	for i := 0; i < 10; i++ {
+		sub, body := w.subs[i%2], "fast"
+		if i%2 == 1 {
+			body = "slow"
+		}
+		msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: sub}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		tasks[string(task.Bytes())] = append(tasks[string(task.Bytes())], task)
+	}
+
+	// the topics are limited independently
+	elapsed := make(map[string]time.Duration)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for topic, ts := range tasks {
+		wg.Add(1)
+		go func(topic string, ts []core.QueuedMessage) {
+			defer wg.Done()
+			for _, task := range ts {
+				assert.NoError(t, w.Run(context.Background(), task))
+			}
+			mu.Lock()
+			elapsed[topic] = time.Since(start)
+			mu.Unlock()
+		}(topic, ts)
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, int64(elapsed["fast"]), int64(4*20*time.Millisecond))
+	assert.Less(t, int64(elapsed["fast"]), int64(4*100*time.Millisecond))
+	assert.GreaterOrEqual(t, int64(elapsed["slow"]), int64(4*100*time.Millisecond))
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("topic_rate_limit_fast"),
+		WithTopicRateLimit("topic_rate_limit_slow", 10, 1),
+	)
+	assert.EqualError(t, err, "rate limited topic topic_rate_limit_slow is not consumed")
+}
+
+func TestNSQTopicPriority(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQDAddr(nsqd.Addr()),
+		WithTopic("priority_low"),
+		WithTopicHandler("priority_high", "ch", func(ctx context.Context, m core.QueuedMessage) error {
+			return nil
+		}),
+		WithLookupdPollInterval(50*time.Millisecond),
+		WithMaxInFlight(2),
+		WithTopicPriority("priority_high", 1),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("priority_low") == "RDY 2" && nsqd.lastRDY("priority_high") == "RDY 2"
+	}, time.Second, 10*time.Millisecond)
+
+	// the low priority topic gets no message while the high priority one has some in flight
+	nsqd.deliverTopic("priority_high", "0123456789abcdef", job.NewMessage(mockMessage{Message: "high"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "high", string(task.Bytes()))
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("priority_low") == "RDY 0"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "RDY 2", nsqd.lastRDY("priority_high"))
+
+	// and gets them again once the high priority topic is drained
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("priority_low") == "RDY 2"
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("priority_low"),
+		WithTopicPriority("priority_high", 1),
+	)
+	assert.EqualError(t, err, "prioritized topic priority_high is not consumed")
+}
+
+func TestNSQValidate(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ping", r.URL.Path)
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer lookupd.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("validate"),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Validate())
+	// nothing is consumed
+	assert.Nil(t, w.consumers())
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.Validate())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQLookupd(lookupd.Listener.Addr().String()),
+		WithTopic("validate"),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Validate())
+	assert.NoError(t, w.Shutdown())
+
+	w, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithProducerAddr(host+":1"),
+		WithNSQDAddr(host+":4150", host+":2"),
+		WithTopic("validate"),
+	)
+	assert.NoError(t, err)
+	err = w.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "producer "+host+":1: ")
+	assert.Contains(t, err.Error(), "consumer "+host+":2: ")
+	assert.NotContains(t, err.Error(), host+":4150")
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQMessageTransform(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("message_transform"),
+		WithInvalidMessagePolicy(RequeueInvalidMessage),
+		WithMessageTransform(func(raw []byte) ([]byte, error) {
+			if !bytes.HasPrefix(raw, []byte("legacy:")) {
+				return nil, errors.New("not a legacy message")
+			}
+			return bytes.TrimPrefix(raw, []byte("legacy:")), nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	invalid, invalidDelegate := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+	legacy, _ := newMockMessage(append([]byte("legacy:"), job.NewMessage(mockMessage{Message: "bar"}).Encode()...))
+	go func() {
+		w.tasks <- &delivery{msg: invalid, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: legacy, sub: w.subs[0]}
+	}()
+
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(task.Bytes()))
+	assert.Len(t, invalidDelegate.requeued(), 1)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQPayloadCompression(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("payload_compression"),
+		WithPayloadCompression(1024),
+	)
+	assert.NoError(t, err)
+
+	large := strings.Repeat("foo", 1000)
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: large})))
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "small"})))
+	bodies := nsqd.published()
+	assert.Len(t, bodies, 2)
+
+	// only the large payload is compressed on the wire
+	assert.True(t, bytes.HasPrefix(bodies[0], compressedPrefix))
+	assert.Less(t, len(bodies[0]), len(large))
+	assert.False(t, bytes.HasPrefix(bodies[1], compressedPrefix))
+
+	for i, want := range []string{large, "small"} {
+		msg, _ := newMockMessage(bodies[i])
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(task.Bytes()))
+	}
+	assert.NoError(t, w.Shutdown())
+
+	_, err = NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("payload_compression"),
+		WithPayloadCompression(0),
+	)
+	assert.Error(t, err)
+}
+
+func TestNSQName(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("name"),
+		WithName("billing"),
+		WithLogger(logger),
+		WithNSQLogLevel(nsq.LogLevelInfo),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Error(t, w.Run(context.Background(), task))
+	assert.NoError(t, w.Shutdown())
+
+	// the worker, consumer and producer logs all carry the name
+	assert.NotEmpty(t, logger.informed())
+	assert.NotEmpty(t, logger.logged())
+	for _, line := range append(logger.informed(), logger.logged()...) {
+		assert.True(t, strings.HasPrefix(line, "[billing] "), line)
+	}
+}
+
+func TestNSQRestart(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("restart"),
+		WithChannel("a"),
+	)
+	assert.NoError(t, err)
+
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, "SUB restart a", nsqd.last("SUB"))
+
+	assert.NoError(t, w.Restart(WithChannel("b"), WithMaxInFlight(2)))
+	assert.Equal(t, "b", w.subs[0].channel)
+	assert.Equal(t, 1, nsqd.count("CLS"))
+	assert.Eventually(t, func() bool {
+		return nsqd.last("SUB") == "SUB restart b" && nsqd.lastRDY("restart") == "RDY 2"
+	}, time.Second, 10*time.Millisecond)
+
+	nsqd.deliver("0000000000000002", job.NewMessage(mockMessage{Message: "bar"}).Encode(), 1)
+	task, err = w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the producer is kept
+	assert.NoError(t, w.Queue(newJob(mockMessage{Message: "baz"})))
+	assert.Len(t, nsqd.published(), 1)
+
+	assert.Error(t, w.Restart(WithChannel("b#invalid")))
+	assert.Error(t, w.Restart(WithTopic("")))
+	assert.Equal(t, "b", w.subs[0].channel)
+	assert.NoError(t, w.Shutdown())
+	assert.Equal(t, queue.ErrQueueShutdown, w.Restart())
+}
+
+func TestNSQRestartBeforeRequest(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("restart_before_request"),
+		WithChannel("a"),
+	)
+	assert.NoError(t, err)
+
+	// the consumer isn't started with the old channel
+	assert.NoError(t, w.Restart(
+		WithChannel("b"),
+		WithMaxInFlight(3),
+		WithMsgTimeout(2*time.Second),
+		WithHeartbeatInterval(time.Second),
+	))
+	assert.Equal(t, 0, nsqd.count("SUB"))
+	assert.Equal(t, 2*time.Second, w.cfg.MsgTimeout)
+	assert.Equal(t, 3, w.cfg.MaxInFlight)
+
+	nsqd.deliver("0000000000000001", job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(task.Bytes()))
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, 1, nsqd.count("SUB"))
+	assert.Equal(t, "SUB restart_before_request b", nsqd.last("SUB"))
+	assert.Equal(t, "RDY 3", nsqd.lastRDY("restart_before_request"))
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQRequeued(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("requeued"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			if string(m.Bytes()) == "fail" {
+				return errors.New("failed")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), w.Requeued())
+
+	for _, body := range []string{"fail", "ok", "fail"} {
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		_ = w.Run(context.Background(), task)
+		assert.Equal(t, body == "ok", d.finished() == 1)
+	}
+	assert.Equal(t, uint64(2), w.Requeued())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQProcessedFailed(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("processed_failed"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			switch string(m.Bytes()) {
+			case "fail":
+				return errors.New("failed")
+			case "panic":
+				panic("boom")
+			}
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	for _, body := range []string{"ok", "fail", "ok", "panic", "ok"} {
+		msg, _ := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		_ = w.Run(context.Background(), task)
+	}
+	assert.Equal(t, uint64(3), w.Processed())
+	assert.Equal(t, uint64(2), w.Failed())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQJobTimeout(t *testing.T) {
+	logger := &mockLogger{}
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("job_timeout"),
+		WithLogger(logger),
+		WithMsgTimeout(2*time.Second),
+		WithHeartbeatInterval(time.Second),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			// ignore ctx and succeed once the job timed out
+			<-ctx.Done()
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	request := func(timeout time.Duration) (*mockDelegate, error) {
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		task.(*job.Message).Timeout = timeout
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		return d, w.Run(ctx, task)
+	}
+
+	// the job times out before nsqd, its message is requeued instead of finished
+	d, err := request(50 * time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, d.finished())
+	assert.Len(t, d.requeued(), 1)
+	assert.Empty(t, logger.logged())
+
+	// nsqd times out the message before the job, it's warned once
+	for i := 0; i < 2; i++ {
+		d, err = request(time.Minute)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Len(t, d.requeued(), 1)
+	}
+	assert.Len(t, logger.logged(), 1)
+	assert.Contains(t, logger.logged()[0], "job timeout 1m0s exceeds the msg timeout 2s")
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQConnectTimeout(t *testing.T) {
+	addr := newStalledNSQD(t)
+	w, err := NewWorker(
+		WithAddr(addr),
+		WithTopic("connect_timeout"),
+		WithConsumerOnly(),
+		WithConnectTimeout(100*time.Millisecond),
+		WithConnectRetry(2, 10*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	err = w.startConsumer()
+	assert.EqualError(t, err, "could not connect nsqd "+addr+" within 100ms")
+	// the retry waits for the pending handshake instead of reporting it connected
+	assert.Less(t, time.Since(start), time.Second)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQProtoCodec(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	var decoded proto.Message
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("proto_codec"),
+		WithCodec(ProtoCodec{New: func() proto.Message { return &wrapperspb.StringValue{} }}),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			decoded = ProtoFromContext(ctx)
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	j, err := NewProtoJob(wrapperspb.String("foo"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Queue(newJob(j)))
+	// the payload must be a message of the job type
+	assert.Error(t, w.Queue(newJob(mockMessage{Message: "foo"})))
+	// proto3 strings must be valid UTF-8
+	_, err = NewProtoJob(wrapperspb.String("\xff"))
+	assert.Error(t, err)
+	// an empty message encodes to an empty body, which nsqd can't publish
+	empty, err := NewProtoJob(wrapperspb.String(""))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, w.Queue(newJob(empty)), ErrEmptyBody)
+	assert.ErrorIs(t, w.Queue(newJob(ProtoJob{Message: wrapperspb.String("foo")})), ErrEmptyBody)
+	bodies := nsqd.published()
+	assert.Len(t, bodies, 1)
+	want, err := proto.Marshal(wrapperspb.String("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, want, bodies[0])
+
+	invalid, invalidDelegate := newMockMessage([]byte{0xff})
+	msg, _ := newMockMessage(bodies[0])
+	go func() {
+		w.tasks <- &delivery{msg: invalid, sub: w.subs[0]}
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, invalidDelegate.finished())
+
+	var v wrapperspb.StringValue
+	assert.NoError(t, proto.Unmarshal(task.Bytes(), &v))
+	assert.Equal(t, "foo", v.GetValue())
+	assert.Equal(t, 60*time.Minute, task.(*job.Message).Timeout)
+
+	// the run func gets the message decoded by the codec
+	assert.NoError(t, w.Run(context.Background(), task))
+	assert.Equal(t, "foo", decoded.(*wrapperspb.StringValue).GetValue())
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQBackpressure(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	release := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("backpressure"),
+		WithMaxInFlight(4),
+		WithBackpressure(),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			<-release
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.startConsumer())
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("backpressure") == "RDY 4"
+	}, time.Second, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	run := func(id string, busy int) {
+		nsqd.deliver(id, job.NewMessage(mockMessage{Message: "foo"}).Encode(), 1)
+		task, err := w.Request()
+		assert.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.Run(context.Background(), task))
+		}()
+		assert.Eventually(t, func() bool {
+			return w.Usage() == busy
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// the RDY drops with the running jobs
+	run("0000000000000001", 1)
+	run("0000000000000002", 2)
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("backpressure") == "RDY 2"
+	}, time.Second, 10*time.Millisecond)
+	run("0000000000000003", 3)
+	run("0000000000000004", 4)
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("backpressure") == "RDY 0"
+	}, time.Second, 10*time.Millisecond)
+
+	// and recovers once they're done
+	close(release)
+	wg.Wait()
+	assert.Eventually(t, func() bool {
+		return nsqd.lastRDY("backpressure") == "RDY 4"
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQDrainTopicOnShutdown(t *testing.T) {
+	nsqd := newMockNSQD(t, host+":0")
+	release := make(chan struct{})
+	w, err := NewWorker(
+		WithAddr(nsqd.Addr()),
+		WithTopic("drain_on_shutdown"),
+		WithShutdownTimeout(100*time.Millisecond),
+		WithDrainTopicOnShutdown("drained"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			<-release
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	body := job.NewMessage(mockMessage{Message: "foo"}).Encode()
+	nsqd.deliver("0000000000000001", body, 1)
+	task, err := w.Request()
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.Run(context.Background(), task)
+	}()
+	assert.Eventually(t, func() bool {
+		return w.Usage() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the job outlives the shutdown timeout, its message lands in the drain topic
+	assert.Error(t, w.Shutdown())
+	assert.Equal(t, "PUB drained", nsqd.last("PUB"))
+	assert.Equal(t, [][]byte{body}, nsqd.published())
+	assert.Eventually(t, func() bool {
+		return nsqd.count("FIN") == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, nsqd.count("REQ"))
+	close(release)
+	<-done
+
+	_, err = NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("drain_on_shutdown"),
+		WithConsumerOnly(),
+		WithDrainTopicOnShutdown("drained"),
+	)
+	assert.EqualError(t, err, "drain topic needs a producer")
+}
+
+func TestNSQConnections(t *testing.T) {
+	nsqd1 := newMockNSQD(t, host+":0")
+	nsqd2 := newMockNSQD(t, host+":0")
+	var producers []string
+	for _, nsqd := range []*mockNSQD{nsqd1, nsqd2} {
+		_, port, err := net.SplitHostPort(nsqd.Addr())
+		assert.NoError(t, err)
+		producers = append(producers, `{"broadcast_address":"`+host+`","tcp_port":`+port+`}`)
+	}
+	lookupd := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("X-NSQ-Content-Type", "nsq; version=1.0")
+		_, _ = rw.Write([]byte(`{"channels":[],"producers":[` + strings.Join(producers, ",") + `]}`))
+	}))
+	defer lookupd.Close()
+
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithNSQLookupd(lookupd.Listener.Addr().String()),
+		WithTopic("connections"),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, w.Connections())
+
+	assert.NoError(t, w.startConsumer())
+	assert.Eventually(t, func() bool {
+		return w.Connections() == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQTLSFiles(t *testing.T) {
+	certFile, keyFile, caFile := writeTestCerts(t)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("tls_files"),
+		WithTLSFiles(certFile, keyFile, caFile),
+	)
+	assert.NoError(t, err)
+	assert.True(t, w.cfg.TlsV1)
+	assert.Len(t, w.cfg.TlsConfig.Certificates, 1)
+	assert.NotNil(t, w.cfg.TlsConfig.RootCAs)
+	assert.NoError(t, w.Shutdown())
+
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for name, files := range map[string][3]string{
+		"missing certificate": {missing, keyFile, caFile},
+		"invalid key":         {certFile, caFile, caFile},
+		"missing ca":          {certFile, keyFile, missing},
+		"invalid ca":          {certFile, keyFile, keyFile},
+	} {
+		_, err = NewWorker(
+			WithAddr(host+":4150"),
+			WithTopic("tls_files"),
+			WithTLSFiles(files[0], files[1], files[2]),
+		)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestNSQRetryExpired(t *testing.T) {
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("retry_expired"),
+		WithRunFunc(func(ctx context.Context, m core.QueuedMessage) error {
+			return errors.New("failed")
+		}),
+	)
+	assert.NoError(t, err)
+
+	msg, d := newMockMessage(job.NewMessage(mockMessage{Message: "foo"}, job.WithRetryCount(1)).Encode())
+	go func() {
+		w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+	}()
+	task, err := w.Request()
+	assert.NoError(t, err)
+
+	// the message is kept in flight for the retry of the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.Error(t, w.Run(ctx, task))
+	assert.Empty(t, d.requeued())
+
+	// and requeued once the queue gives up on the job before retrying it
+	cancel()
+	assert.Eventually(t, func() bool {
+		return len(d.requeued()) == 1
+	}, time.Second, 10*time.Millisecond)
+	_, ok := w.inflight.Load(task)
+	assert.False(t, ok)
+	assert.NoError(t, w.Shutdown())
+}
+
+func TestNSQBatchJobTimeout(t *testing.T) {
+	batches := make(chan []string, 2)
+	w, err := NewWorker(
+		WithAddr(host+":4150"),
+		WithTopic("batch_job_timeout"),
+		WithBatch(2, time.Hour, func(ctx context.Context, jobs []core.QueuedMessage) error {
+			bodies := []string{}
+			for _, m := range jobs {
+				bodies = append(bodies, string(m.Bytes()))
+			}
+			batches <- bodies
+			return nil
+		}),
+	)
+	assert.NoError(t, err)
+
+	request := func(body string) (core.QueuedMessage, *mockDelegate) {
+		msg, d := newMockMessage(job.NewMessage(mockMessage{Message: body}).Encode())
+		go func() {
+			w.tasks <- &delivery{msg: msg, sub: w.subs[0]}
+		}()
+		task, err := w.Request()
+		assert.NoError(t, err)
+		return task, d
+	}
+
+	// the job leaves the pending batch once it times out
+	task, timedOut := request("foo")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, w.Run(ctx, task), context.DeadlineExceeded)
+	assert.Len(t, timedOut.requeued(), 1)
+
+	var wg sync.WaitGroup
+	delegates := []*mockDelegate{}
+	for _, body := range []string{"bar", "baz"} {
+		task, d := request(body)
+		delegates = append(delegates, d)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.Run(context.Background(), task))
+		}()
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []string{"bar", "baz"}, <-batches)
+	assert.Equal(t, 0, timedOut.finished())
+	for _, d := range delegates {
+		assert.Equal(t, 1, d.finished())
+	}
+	assert.NoError(t, w.Shutdown())
+}
@@ -2,11 +2,48 @@ package nsq
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/golang-queue/queue"
 	"github.com/golang-queue/queue/core"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InvalidMessagePolicy decides what happens to messages which can't be decoded
+type InvalidMessagePolicy int
+
+const (
+	// DropInvalidMessage finishes the message so nsqd never delivers it again
+	DropInvalidMessage InvalidMessagePolicy = iota
+	// RequeueInvalidMessage requeues the message to nsqd
+	RequeueInvalidMessage
+)
+
+// QueueFullPolicy decides what Queue does when nsqd fails to acknowledge a publish
+type QueueFullPolicy int
+
+const (
+	// FailOnQueueFull returns the error of the publish
+	FailOnQueueFull QueueFullPolicy = iota
+	// RetryOnQueueFull retries the publish with the attempts and the backoff set by WithPublishRetry
+	RetryOnQueueFull
+	// BlockOnQueueFull retries the publish with the backoff set by WithPublishRetry
+	// until it's acknowledged or the timeout set by WithPublishTimeout elapsed,
+	// an attempt still waiting for nsqd is abandoned at the timeout
+	BlockOnQueueFull
 )
 
+// RunFunc handles a job
+type RunFunc func(context.Context, core.QueuedMessage) error
+
 // An Option configures a mutex.
 type Option interface {
 	Apply(*Options)
@@ -21,12 +58,132 @@ func (f OptionFunc) Apply(option *Options) {
 }
 
 type Options struct {
-	maxInFlight int
-	addr        string
-	topic       string
-	channel     string
-	runFunc     func(context.Context, core.QueuedMessage) error
-	logger      queue.Logger
+	config          *nsq.Config
+	maxInFlight     int
+	handlers        int
+	addr            string
+	producerAddr    string
+	nsqdAddrs       []string
+	lookupdAddrs    []string
+	topic           string
+	channel         string
+	topics          []TopicChannel
+	topicHandlers   []topicHandler
+	ephemeral       bool
+	runFunc         func(context.Context, core.QueuedMessage) error
+	middlewares     []func(RunFunc) RunFunc
+	batchSize       int
+	batchInterval   time.Duration
+	batchFunc       BatchFunc
+	baseContext     func() context.Context
+	errorFunc       func(core.QueuedMessage, error)
+	successFunc     func(core.QueuedMessage, time.Duration)
+	publishFunc     func(core.QueuedMessage, error)
+	publishObserver func(time.Duration, error)
+	connListener    func(ConnEvent)
+	logger          queue.Logger
+	name            string
+	nsqLogLevel     nsq.LogLevel
+	tlsConfig       *tls.Config
+	authSecret      string
+	deflate         bool
+	deflateLevel    int
+	snappy          bool
+	codec           Codec
+	registerer      prometheus.Registerer
+	tracerProvider  trace.TracerProvider
+
+	invalidMessagePolicy InvalidMessagePolicy
+	emptyBodyHandler     func(*nsq.Message) error
+	transform            func([]byte) ([]byte, error)
+	compressionThreshold int
+	queueFullPolicy      QueueFullPolicy
+	dedupeStore          DedupeStore
+	dedupeTTL            time.Duration
+	publishRetryAttempts int
+	publishRetryDelay    time.Duration
+	publishTimeout       time.Duration
+	maxAttempts          uint16
+	deadLetterFunc       func(*nsq.Message)
+	deadLetterTopic      string
+	drainTopic           string
+
+	heartbeatInterval time.Duration
+	msgTimeout        time.Duration
+	autoTouchInterval time.Duration
+	defaultTimeout    time.Duration
+
+	clientID     string
+	hostname     string
+	userAgent    string
+	sampleRate   int32
+	dialTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	lookupdPollInterval time.Duration
+	lookupdPollJitter   *float64
+
+	topicCreateAddr   string
+	channelCreateAddr string
+
+	maxInFlightPerConn      int
+	lowRdyIdleTimeout       time.Duration
+	rdyRedistributeInterval time.Duration
+	backpressure            bool
+
+	concurrencyLimit int
+	rateLimit        int
+	rateBurst        int
+	topicRateLimits  map[string]topicRate
+	topicPriorities  map[string]int
+
+	outputBufferSize    int64
+	outputBufferTimeout time.Duration
+
+	maxBackoffDuration time.Duration
+	backoffMultiplier  time.Duration
+	backoffDisabled    bool
+
+	defaultRequeueDelay time.Duration
+	maxRequeueDelay     time.Duration
+
+	shutdownTimeout time.Duration
+
+	consumerOnly bool
+	producerOnly bool
+
+	producer *nsq.Producer
+	consumer *nsq.Consumer
+
+	connectRetryAttempts int
+	connectRetryDelay    time.Duration
+	startupJitter        time.Duration
+	connectTimeout       time.Duration
+
+	reconnectAttempts int
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+
+	// err keeps the first invalid option, reported by NewWorker
+	err error
+}
+
+// WithConfig use a copy of cfg, created by nsq.NewConfig, as the base config.
+// The other options override its fields, except MaxInFlight, MaxAttempts,
+// SampleRate and AuthSecret which are only overridden by the options given after WithConfig.
+func WithConfig(cfg *nsq.Config) Option {
+	return OptionFunc(func(o *Options) {
+		if cfg == nil {
+			o.setErr(errors.New("config must not be nil"))
+			return
+		}
+		o.config = cfg
+		o.maxInFlight = cfg.MaxInFlight
+		o.maxAttempts = cfg.MaxAttempts
+		o.sampleRate = cfg.SampleRate
+		o.authSecret = cfg.AuthSecret
+	})
 }
 
 // WithAddr setup the addr of NSQ
@@ -36,6 +193,122 @@ func WithAddr(addr string) Option {
 	})
 }
 
+// WithProducerAddr setup the nsqd address the producer publishes to, default is addr
+func WithProducerAddr(addr string) Option {
+	return OptionFunc(func(o *Options) {
+		o.producerAddr = addr
+	})
+}
+
+// WithTopicCreate create the published topics with the HTTP API of the nsqd at addr
+// when the worker is created, for the nsqd which don't create the topics on publish
+func WithTopicCreate(addr string) Option {
+	return OptionFunc(func(o *Options) {
+		o.topicCreateAddr = addr
+	})
+}
+
+// WithChannelCreate create the consumed channels with the HTTP API of the nsqd at addr
+// before the consumer connects, so they keep the messages published before the first connection
+func WithChannelCreate(addr string) Option {
+	return OptionFunc(func(o *Options) {
+		o.channelCreateAddr = addr
+	})
+}
+
+// WithShutdownTimeout set how long Shutdown waits for the running jobs and the consumer,
+// default is no timeout
+func WithShutdownTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.shutdownTimeout = d
+	})
+}
+
+// WithConsumerOnly skip the producer, the worker can't queue jobs
+func WithConsumerOnly() Option {
+	return OptionFunc(func(o *Options) {
+		o.consumerOnly = true
+	})
+}
+
+// WithProducerOnly skip the consumer, the worker can't request jobs
+func WithProducerOnly() Option {
+	return OptionFunc(func(o *Options) {
+		o.producerOnly = true
+	})
+}
+
+// WithProducer publish the jobs with p instead of a producer created by the worker,
+// the worker stops p on shutdown
+func WithProducer(p *nsq.Producer) Option {
+	return OptionFunc(func(o *Options) {
+		if p == nil {
+			o.setErr(errors.New("producer must not be nil"))
+			return
+		}
+		o.producer = p
+	})
+}
+
+// WithConsumer consume the topic set by WithTopic with q instead of a consumer created by
+// the worker. q must have no handler and no connection yet, the worker adds its handlers,
+// connects q to NSQ with the addresses of the options and stops q on shutdown.
+func WithConsumer(q *nsq.Consumer) Option {
+	return OptionFunc(func(o *Options) {
+		if q == nil {
+			o.setErr(errors.New("consumer must not be nil"))
+			return
+		}
+		o.consumer = q
+	})
+}
+
+// WithNSQDAddr setup the nsqd addresses the consumer connects to directly.
+// The producer keeps publishing to addr.
+func WithNSQDAddr(addrs ...string) Option {
+	return OptionFunc(func(o *Options) {
+		o.nsqdAddrs = addrs
+	})
+}
+
+// WithNSQLookupd setup the nsqlookupd HTTP addresses used by the consumer
+// to discover nsqd producers. The producer keeps publishing to addr.
+func WithNSQLookupd(addrs ...string) Option {
+	return OptionFunc(func(o *Options) {
+		o.lookupdAddrs = addrs
+	})
+}
+
+// WithLookupdPollInterval set the duration between the nsqlookupd polls, between 10ms and 5m
+func WithLookupdPollInterval(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.lookupdPollInterval = d
+	})
+}
+
+// WithLookupdPollJitter set the fraction (0-1) of jitter added to the nsqlookupd poll interval
+func WithLookupdPollJitter(f float64) Option {
+	return OptionFunc(func(o *Options) {
+		o.lookupdPollJitter = &f
+	})
+}
+
+// WithLowRdyIdleTimeout set how long a connection stays idle before its RDY is
+// redistributed to the other connections, between 1s and 5m
+func WithLowRdyIdleTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.lowRdyIdleTimeout = d
+	})
+}
+
+// WithRDYRedistributeInterval set the duration between the RDY redistributions
+// across the connections, between 1ms and 5s
+func WithRDYRedistributeInterval(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.rdyRedistributeInterval = d
+	})
+}
+
 // WithTopic setup the topic of NSQ
 func WithTopic(topic string) Option {
 	return OptionFunc(func(o *Options) {
@@ -50,6 +323,45 @@ func WithChannel(channel string) Option {
 	})
 }
 
+// TopicChannel is a topic consumed from a channel, the default channel is used when it's empty
+type TopicChannel struct {
+	Topic   string
+	Channel string
+}
+
+// WithTopics consume more topics with the same run func,
+// the jobs are still published to the topic set by WithTopic
+func WithTopics(topics []TopicChannel) Option {
+	return OptionFunc(func(o *Options) {
+		o.topics = append(o.topics, topics...)
+	})
+}
+
+// topicHandler is a topic consumed with its own run func
+type topicHandler struct {
+	TopicChannel
+	run RunFunc
+}
+
+// WithTopicHandler consume one more topic, its jobs are run by fn instead of the run func
+func WithTopicHandler(topic, channel string, fn func(context.Context, core.QueuedMessage) error) Option {
+	return OptionFunc(func(o *Options) {
+		o.topicHandlers = append(o.topicHandlers, topicHandler{
+			TopicChannel: TopicChannel{Topic: topic, Channel: channel},
+			run:          fn,
+		})
+	})
+}
+
+// WithEphemeralChannel add the #ephemeral suffix to the channel. nsqd deletes
+// ephemeral channels once the last consumer disconnects, so they don't
+// accumulate messages while no worker is running.
+func WithEphemeralChannel() Option {
+	return OptionFunc(func(o *Options) {
+		o.ephemeral = true
+	})
+}
+
 // WithRunFunc setup the run func of queue
 func WithRunFunc(fn func(context.Context, core.QueuedMessage) error) Option {
 	return OptionFunc(func(o *Options) {
@@ -57,6 +369,93 @@ func WithRunFunc(fn func(context.Context, core.QueuedMessage) error) Option {
 	})
 }
 
+// WithBatch run the jobs with fn in batches instead of the run func, a batch is
+// run once it has size jobs or flush elapsed since its first job. The jobs of a
+// batch are finished once fn succeeds or requeued once it fails, the max in
+// flight and the worker count of the queue should allow size jobs running at once.
+func WithBatch(size int, flush time.Duration, fn func(ctx context.Context, jobs []core.QueuedMessage) error) Option {
+	return OptionFunc(func(o *Options) {
+		if size <= 0 {
+			o.setErr(errors.New("batch size must be positive"))
+			return
+		}
+		if flush <= 0 {
+			o.setErr(errors.New("batch flush interval must be positive"))
+			return
+		}
+		if fn == nil {
+			o.setErr(errors.New("batch func must not be nil"))
+			return
+		}
+		o.batchSize = size
+		o.batchInterval = flush
+		o.batchFunc = fn
+	})
+}
+
+// WithMiddleware wrap the run func with the middlewares, the first one is the outermost
+func WithMiddleware(mw ...func(next RunFunc) RunFunc) Option {
+	return OptionFunc(func(o *Options) {
+		o.middlewares = append(o.middlewares, mw...)
+	})
+}
+
+// WithErrorHandler set the func called with the job and its error when the run func
+// fails or panics, the error of a panic is a *PanicError
+func WithErrorHandler(fn func(core.QueuedMessage, error)) Option {
+	return OptionFunc(func(o *Options) {
+		o.errorFunc = fn
+	})
+}
+
+// WithSuccessHandler set the func called with the job and its duration when the run func succeeds
+func WithSuccessHandler(fn func(core.QueuedMessage, time.Duration)) Option {
+	return OptionFunc(func(o *Options) {
+		o.successFunc = fn
+	})
+}
+
+// WithBaseContext set the func returning the parent context of every job,
+// the deadline of the job still applies. Default is context.Background().
+func WithBaseContext(fn func() context.Context) Option {
+	return OptionFunc(func(o *Options) {
+		o.baseContext = fn
+	})
+}
+
+// WithContext set the parent context of every job like WithBaseContext,
+// canceling ctx cancels the context of all the running jobs.
+func WithContext(ctx context.Context) Option {
+	return OptionFunc(func(o *Options) {
+		o.baseContext = func() context.Context {
+			return ctx
+		}
+	})
+}
+
+// WithPublishCallback setup the func called with the result of every QueueAsync.
+// The results are reported one at a time in their order, the callback may queue again.
+func WithPublishCallback(fn func(core.QueuedMessage, error)) Option {
+	return OptionFunc(func(o *Options) {
+		o.publishFunc = fn
+	})
+}
+
+// WithPublishObserver set the func called with the duration and the error of the
+// publishes of Queue, QueueContext, QueueWithMetadata, QueueWithDelay and QueueBatch
+func WithPublishObserver(fn func(time.Duration, error)) Option {
+	return OptionFunc(func(o *Options) {
+		o.publishObserver = fn
+	})
+}
+
+// WithConnectionListener set the func called with the changes of the consumer connections to nsqd
+func WithConnectionListener(fn func(event ConnEvent)) Option {
+	return OptionFunc(func(o *Options) {
+		o.connListener = fn
+	})
+}
+
 // WithMaxInFlight Maximum number of messages to allow in flight (concurrency knob)
 func WithMaxInFlight(num int) Option {
 	return OptionFunc(func(o *Options) {
@@ -64,6 +463,93 @@ func WithMaxInFlight(num int) Option {
 	})
 }
 
+// WithMaxInFlightPerConn cap the number of messages in flight on each nsqd connection
+// of a consumer. NSQ divides WithMaxInFlight between the connections, so it's lowered
+// to n times the number of connections when it would give more than n to each.
+func WithMaxInFlightPerConn(n int) Option {
+	return OptionFunc(func(o *Options) {
+		if n <= 0 {
+			o.setErr(errors.New("max in flight per connection must be positive"))
+			return
+		}
+		o.maxInFlightPerConn = n
+	})
+}
+
+// WithBackpressure lower the max in flight of the consumers by the number of running jobs,
+// so nsqd stops delivering while the jobs saturate the worker instead of the messages
+// waiting in memory
+func WithBackpressure() Option {
+	return OptionFunc(func(o *Options) {
+		o.backpressure = true
+	})
+}
+
+// WithConcurrencyLimit set how many jobs of the worker run at the same time, below WithMaxInFlight
+// the other messages in flight wait for their turn and are kept alive with WithAutoTouch
+func WithConcurrencyLimit(n int) Option {
+	return OptionFunc(func(o *Options) {
+		if n <= 0 {
+			o.setErr(errors.New("concurrency limit must be positive"))
+			return
+		}
+		o.concurrencyLimit = n
+	})
+}
+
+// WithRateLimit set how many jobs of the worker start per second, up to burst at once.
+// The jobs waiting for their turn stay in flight until the worker is shutdown.
+func WithRateLimit(rps, burst int) Option {
+	return OptionFunc(func(o *Options) {
+		if rps <= 0 || burst <= 0 {
+			o.setErr(errors.New("rate limit and burst must be positive"))
+			return
+		}
+		o.rateLimit = rps
+		o.rateBurst = burst
+	})
+}
+
+// topicRate is the rate limit of the jobs of a topic
+type topicRate struct {
+	rps   int
+	burst int
+}
+
+// WithTopicRateLimit set how many jobs of the topic start per second, up to burst at once,
+// independently from the other topics. The limit of WithRateLimit applies on top of it.
+func WithTopicRateLimit(topic string, rps, burst int) Option {
+	return OptionFunc(func(o *Options) {
+		if rps <= 0 || burst <= 0 {
+			o.setErr(errors.New("rate limit and burst must be positive"))
+			return
+		}
+		if o.topicRateLimits == nil {
+			o.topicRateLimits = make(map[string]topicRate)
+		}
+		o.topicRateLimits[topic] = topicRate{rps: rps, burst: burst}
+	})
+}
+
+// WithTopicPriority set the priority of a consumed topic, default is 0. The consumers of
+// the topics with a lower priority don't receive messages while a topic with a higher
+// priority has messages in flight, so the higher priority topics are drained first.
+func WithTopicPriority(topic string, priority int) Option {
+	return OptionFunc(func(o *Options) {
+		if o.topicPriorities == nil {
+			o.topicPriorities = make(map[string]int)
+		}
+		o.topicPriorities[topic] = priority
+	})
+}
+
+// WithConcurrentHandlers set the number of goroutines handling the messages of the consumer
+func WithConcurrentHandlers(n int) Option {
+	return OptionFunc(func(o *Options) {
+		o.handlers = n
+	})
+}
+
 // WithLogger set custom logger
 func WithLogger(l queue.Logger) Option {
 	return OptionFunc(func(o *Options) {
@@ -71,14 +557,453 @@ func WithLogger(l queue.Logger) Option {
 	})
 }
 
+// WithName set the name of the worker, the lines it logs are prefixed with it
+func WithName(name string) Option {
+	return OptionFunc(func(o *Options) {
+		o.name = name
+	})
+}
+
+// WithNSQLogLevel set the minimum level of the NSQ consumer and producer logs sent to the logger
+func WithNSQLogLevel(level nsq.LogLevel) Option {
+	return OptionFunc(func(o *Options) {
+		o.nsqLogLevel = level
+	})
+}
+
+// WithTLS enable TLS for both the producer and consumer connections
+func WithTLS(cfg *tls.Config) Option {
+	return OptionFunc(func(o *Options) {
+		o.tlsConfig = cfg
+	})
+}
+
+// WithTLSFiles enable TLS like WithTLS with the client certificate and key loaded from
+// certFile and keyFile, nsqd is verified with the CA bundle of caFile. NSQ sends the host
+// of the nsqd address as the server name.
+func WithTLSFiles(certFile, keyFile, caFile string) Option {
+	return OptionFunc(func(o *Options) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			o.setErr(fmt.Errorf("could not load TLS certificate %s and key %s: %w", certFile, keyFile, err))
+			return
+		}
+
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			o.setErr(fmt.Errorf("could not read TLS CA bundle: %w", err))
+			return
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			o.setErr(fmt.Errorf("no certificate found in TLS CA bundle %s", caFile))
+			return
+		}
+
+		o.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      roots,
+			MinVersion:   tls.VersionTLS12,
+		}
+	})
+}
+
+// WithAuthSecret set the secret sent to nsqd for AUTH
+func WithAuthSecret(secret string) Option {
+	return OptionFunc(func(o *Options) {
+		if secret == "" {
+			o.setErr(errors.New("auth secret must not be empty"))
+			return
+		}
+		o.authSecret = secret
+	})
+}
+
+// WithDeflate enable Deflate compression with the given level (1-9)
+func WithDeflate(level int) Option {
+	return OptionFunc(func(o *Options) {
+		o.deflate = true
+		o.deflateLevel = level
+	})
+}
+
+// WithSnappy enable Snappy compression, it can't be used with WithDeflate
+func WithSnappy() Option {
+	return OptionFunc(func(o *Options) {
+		o.snappy = true
+	})
+}
+
+// WithHeartbeatInterval set the duration between nsqd heartbeats
+func WithHeartbeatInterval(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if d <= 0 {
+			o.setErr(errors.New("heartbeat interval must be positive"))
+			return
+		}
+		o.heartbeatInterval = d
+	})
+}
+
+// WithMsgTimeout set the server-side timeout of messages delivered to the worker.
+// nsqd re-delivers a message once it expires, so keep it longer than the
+// job timeout given by job.WithTimeout to avoid processing a job twice.
+func WithMsgTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.msgTimeout = d
+	})
+}
+
+// WithDefaultTimeout set the timeout of the jobs consumed without one, e.g. the
+// messages published by other producers, default is 60 minutes like job.NewMessage
+func WithDefaultTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if d <= 0 {
+			o.setErr(errors.New("default timeout must be positive"))
+			return
+		}
+		o.defaultTimeout = d
+	})
+}
+
+// WithAutoTouch touch the message every interval while its job is running,
+// so nsqd doesn't re-deliver long-running jobs after the msg timeout.
+func WithAutoTouch(interval time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.autoTouchInterval = interval
+	})
+}
+
+// WithClientID set the client ID identifying the worker to nsqd
+func WithClientID(id string) Option {
+	return OptionFunc(func(o *Options) {
+		o.clientID = id
+	})
+}
+
+// WithHostname set the hostname identifying the worker to nsqd
+func WithHostname(h string) Option {
+	return OptionFunc(func(o *Options) {
+		o.hostname = h
+	})
+}
+
+// WithUserAgent set the user agent identifying the worker to nsqd
+func WithUserAgent(ua string) Option {
+	return OptionFunc(func(o *Options) {
+		o.userAgent = ua
+	})
+}
+
+// WithSampleRate set the percentage (0-99) of the messages nsqd delivers to the consumer,
+// 0 disables sampling
+func WithSampleRate(rate int32) Option {
+	return OptionFunc(func(o *Options) {
+		if rate < 0 || rate > 99 {
+			o.setErr(fmt.Errorf("sample rate %d must be between 0 and 99", rate))
+			return
+		}
+		o.sampleRate = rate
+	})
+}
+
+// WithOutputBufferSize set the size in bytes of the buffer nsqd uses for writing
+// to the consumer, a negative size disables the buffering
+func WithOutputBufferSize(size int64) Option {
+	return OptionFunc(func(o *Options) {
+		if size < 0 {
+			size = -1
+		} else if size < 64 {
+			o.setErr(fmt.Errorf("output buffer size %d must be at least 64 bytes", size))
+			return
+		}
+		o.outputBufferSize = size
+	})
+}
+
+// WithOutputBufferTimeout set how long nsqd buffers the writes to the consumer,
+// it must be between 1ms and 30s (the default max of nsqd), a negative duration
+// disables the timeout
+func WithOutputBufferTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if d < 0 {
+			d = -time.Millisecond
+		} else if d < time.Millisecond || d > 30*time.Second {
+			o.setErr(fmt.Errorf("output buffer timeout %s must be between 1ms and 30s", d))
+			return
+		}
+		o.outputBufferTimeout = d
+	})
+}
+
+// WithDialTimeout set the timeout for connecting to nsqd and nsqlookupd
+func WithDialTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.dialTimeout = d
+	})
+}
+
+// WithReadTimeout set the deadline for reading from nsqd, it must be between 100ms and 5m
+func WithReadTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.readTimeout = d
+	})
+}
+
+// WithWriteTimeout set the deadline for writing to nsqd, it must be between 100ms and 5m
+func WithWriteTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.writeTimeout = d
+	})
+}
+
+// WithMaxBackoffDuration set the maximum duration the consumer backs off for after errors
+func WithMaxBackoffDuration(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.maxBackoffDuration = d
+	})
+}
+
+// WithBackoffMultiplier set the unit of time used to compute the backoff duration
+func WithBackoffMultiplier(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.backoffMultiplier = d
+	})
+}
+
+// WithBackoffDisabled requeue the failed messages immediately without backing off the consumer
+func WithBackoffDisabled() Option {
+	return OptionFunc(func(o *Options) {
+		o.backoffDisabled = true
+	})
+}
+
+// WithDefaultRequeueDelay set the delay of the failed messages requeued without a RequeueError,
+// it's multiplied by the attempts of the message
+func WithDefaultRequeueDelay(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.defaultRequeueDelay = d
+	})
+}
+
+// WithMaxRequeueDelay set the maximum delay of the requeued messages, including the RequeueError delays
+func WithMaxRequeueDelay(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.maxRequeueDelay = d
+	})
+}
+
+// WithMetrics register the Prometheus metrics of the jobs to the registerer
+func WithMetrics(reg prometheus.Registerer) Option {
+	return OptionFunc(func(o *Options) {
+		o.registerer = reg
+	})
+}
+
+// WithTracer emit OpenTelemetry spans for the published and processed jobs,
+// the trace context is carried in the message body with the default JSON codec
+func WithTracer(tp trace.TracerProvider) Option {
+	return OptionFunc(func(o *Options) {
+		o.tracerProvider = tp
+	})
+}
+
+// WithCodec set the codec used to encode and decode the jobs, default is JSON
+func WithCodec(c Codec) Option {
+	return OptionFunc(func(o *Options) {
+		o.codec = c
+	})
+}
+
+// WithInvalidMessagePolicy set what to do with messages which can't be decoded,
+// default is DropInvalidMessage
+func WithInvalidMessagePolicy(p InvalidMessagePolicy) Option {
+	return OptionFunc(func(o *Options) {
+		o.invalidMessagePolicy = p
+	})
+}
+
+// WithPayloadCompression gzip the published bodies larger than threshold bytes,
+// the consumers decompress them whether the option is set or not
+func WithPayloadCompression(threshold int) Option {
+	return OptionFunc(func(o *Options) {
+		if threshold <= 0 {
+			o.setErr(errors.New("compression threshold must be positive"))
+			return
+		}
+		o.compressionThreshold = threshold
+	})
+}
+
+// WithMessageTransform set the func rewriting the body of the messages before they're decoded,
+// the messages it fails for are handled like the invalid messages
+func WithMessageTransform(fn func(raw []byte) ([]byte, error)) Option {
+	return OptionFunc(func(o *Options) {
+		o.transform = fn
+	})
+}
+
+// WithEmptyBodyHandler set the func called with the messages which have an empty body,
+// a returned error requeues the message. Default is to finish and discard them.
+func WithEmptyBodyHandler(fn func(*nsq.Message) error) Option {
+	return OptionFunc(func(o *Options) {
+		o.emptyBodyHandler = fn
+	})
+}
+
+// WithDeduplication skip the jobs of the messages recorded in store, the ID of a
+// message is recorded for ttl once its job succeeded. The skipped messages are finished.
+func WithDeduplication(store DedupeStore, ttl time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if store == nil {
+			o.setErr(errors.New("dedupe store must not be nil"))
+			return
+		}
+		if ttl <= 0 {
+			o.setErr(errors.New("dedupe ttl must be positive"))
+			return
+		}
+		o.dedupeStore = store
+		o.dedupeTTL = ttl
+	})
+}
+
+// WithQueueFullPolicy set what to do when nsqd fails to acknowledge the publish of
+// Queue, QueueContext, QueueWithMetadata, QueueWithDelay or QueueBatch,
+// default is FailOnQueueFull
+func WithQueueFullPolicy(p QueueFullPolicy) Option {
+	return OptionFunc(func(o *Options) {
+		o.queueFullPolicy = p
+	})
+}
+
+// WithPublishRetry set how many times a publish is tried and the delay before the
+// first retry, doubled for every next one. Default is 3 attempts from 100ms.
+func WithPublishRetry(attempts int, delay time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if attempts < 1 || delay <= 0 {
+			o.setErr(errors.New("publish retry attempts and delay must be positive"))
+			return
+		}
+		o.publishRetryAttempts = attempts
+		o.publishRetryDelay = delay
+	})
+}
+
+// WithPublishTimeout set how long BlockOnQueueFull blocks on a publish, default is 10s
+func WithPublishTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if d <= 0 {
+			o.setErr(errors.New("publish timeout must be positive"))
+			return
+		}
+		o.publishTimeout = d
+	})
+}
+
+// WithMaxAttempts set how many times a message is delivered before it's dropped,
+// 0 means unlimited and default is 5
+func WithMaxAttempts(n uint16) Option {
+	return OptionFunc(func(o *Options) {
+		o.maxAttempts = n
+	})
+}
+
+// WithDeadLetterFunc set the func called with the messages dropped after max attempts
+func WithDeadLetterFunc(fn func(*nsq.Message)) Option {
+	return OptionFunc(func(o *Options) {
+		o.deadLetterFunc = fn
+	})
+}
+
+// WithDeadLetterTopic publish the body of the messages dropped after max attempts
+// to the topic. NSQ messages carry no headers, so the body is kept as is.
+func WithDeadLetterTopic(topic string) Option {
+	return OptionFunc(func(o *Options) {
+		o.deadLetterTopic = topic
+	})
+}
+
+// WithDrainTopicOnShutdown publish the body of the messages still in flight when Shutdown
+// times out to the topic and finish them, instead of letting nsqd requeue them
+func WithDrainTopicOnShutdown(topic string) Option {
+	return OptionFunc(func(o *Options) {
+		o.drainTopic = topic
+	})
+}
+
+// WithConnectRetry set how many times the consumer tries to connect to NSQ
+// and how long it waits between the attempts
+func WithConnectRetry(attempts int, delay time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		o.connectRetryAttempts = attempts
+		o.connectRetryDelay = delay
+	})
+}
+
+// WithConnectTimeout set how long the consumer waits for the dial and IDENTIFY handshake
+// with each nsqd, a connection which completes later is kept as NSQ can't abort it
+func WithConnectTimeout(d time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		o.connectTimeout = d
+	})
+}
+
+// WithStartupJitter delay the first connection of the consumer by a random duration up to max,
+// to spread the connections of the workers restarted together
+func WithStartupJitter(max time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if max < 0 {
+			o.setErr(errors.New("startup jitter must not be negative"))
+			return
+		}
+		o.startupJitter = max
+	})
+}
+
+// WithReconnect reconnect the consumer to the nsqd addresses it lost a connection to,
+// without nsqlookupd. The delay between the attempts doubles up to maxDelay and the
+// worker gives up after the given attempts, keeping the NSQ reconnects every lookupd poll interval.
+func WithReconnect(attempts int, delay, maxDelay time.Duration) Option {
+	return OptionFunc(func(o *Options) {
+		if attempts < 1 {
+			o.setErr(errors.New("reconnect attempts must be positive"))
+			return
+		}
+		if delay <= 0 || maxDelay < delay {
+			o.setErr(fmt.Errorf("reconnect delay %s must be positive and at most the max delay %s", delay, maxDelay))
+			return
+		}
+		o.reconnectAttempts = attempts
+		o.reconnectDelay = delay
+		o.reconnectMaxDelay = maxDelay
+	})
+}
+
+func (o *Options) setErr(err error) {
+	if o.err == nil {
+		o.err = err
+	}
+}
+
 func newOptions(opts ...Option) Options {
 	defaultOpts := Options{
 		addr:        "127.0.0.1:4150",
-		topic:       "gorush",
-		channel:     "ch",
 		maxInFlight: 1,
 
-		logger: queue.NewLogger(),
+		maxAttempts:          5,
+		defaultTimeout:       60 * time.Minute,
+		connectRetryAttempts: 1,
+		publishRetryAttempts: 3,
+		publishRetryDelay:    100 * time.Millisecond,
+		publishTimeout:       10 * time.Second,
+
+		codec:       jsonCodec{},
+		logger:      queue.NewLogger(),
+		nsqLogLevel: nsq.LogLevelWarning,
 		runFunc: func(context.Context, core.QueuedMessage) error {
 			return nil
 		},
@@ -90,5 +1015,27 @@ func newOptions(opts ...Option) Options {
 		opt.Apply(&defaultOpts)
 	}
 
+	defaultOpts.runFunc = defaultOpts.chain(defaultOpts.runFunc)
+	for i := range defaultOpts.topicHandlers {
+		defaultOpts.topicHandlers[i].run = defaultOpts.chain(defaultOpts.topicHandlers[i].run)
+	}
+
+	if defaultOpts.producerAddr == "" {
+		defaultOpts.producerAddr = defaultOpts.addr
+	}
+
+	if defaultOpts.name != "" {
+		defaultOpts.logger = namedLogger{name: defaultOpts.name, logger: defaultOpts.logger}
+	}
+
 	return defaultOpts
 }
+
+// chain wraps run with the middlewares
+func (o *Options) chain(run RunFunc) RunFunc {
+	for i := len(o.middlewares) - 1; i >= 0; i-- {
+		run = o.middlewares[i](run)
+	}
+
+	return run
+}
@@ -0,0 +1,47 @@
+package nsq
+
+import "sync/atomic"
+
+// consumes reports whether one of subs consumes the topic
+func consumes(subs []*subscription, topic string) bool {
+	for _, sub := range subs {
+		if sub.topic == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prioritize throttles the consumers of the topics with a lower priority than a topic
+// with messages in flight, and releases them once the higher priorities are drained.
+func (w *Worker) prioritize() {
+	if len(w.opts.topicPriorities) == 0 || atomic.LoadInt32(&w.stopFlag) == 1 {
+		return
+	}
+
+	busy, top := false, 0
+	for _, sub := range w.subs {
+		s := sub.q.Stats()
+		if s.MessagesReceived == s.MessagesFinished+s.MessagesRequeued {
+			continue
+		}
+		if p := w.opts.topicPriorities[sub.topic]; !busy || p > top {
+			busy, top = true, p
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, sub := range w.subs {
+		throttled := busy && w.opts.topicPriorities[sub.topic] < top
+		if throttled == sub.throttled {
+			continue
+		}
+		sub.throttled = throttled
+		if atomic.LoadInt32(&w.paused) == 0 {
+			sub.q.ChangeMaxInFlight(w.maxInFlight(sub, sub.q.Stats().Connections))
+		}
+	}
+}
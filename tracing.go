@@ -0,0 +1,77 @@
+package nsq
+
+import (
+	"context"
+
+	"github.com/golang-queue/queue/core"
+	"github.com/golang-queue/queue/job"
+	nsq "github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/golang-queue/nsq"
+
+// the trace context is carried in the envelope of the message body
+var propagator = propagation.TraceContext{}
+
+// startPublishSpan starts the span of a publish, the span is nil without tracer
+func (w *Worker) startPublishSpan(ctx context.Context) (context.Context, trace.Span) {
+	if w.tracer == nil {
+		return ctx, nil
+	}
+
+	return w.tracer.Start(ctx, w.opts.topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination", w.opts.topic),
+		),
+	)
+}
+
+// startRunSpan starts the span of a job, msg is nil for the jobs not consumed from NSQ
+func (w *Worker) startRunSpan(
+	ctx context.Context, task core.QueuedMessage, sub *subscription, msg *nsq.Message, carrier map[string]string,
+) (context.Context, trace.Span) {
+	if w.tracer == nil {
+		return ctx, nil
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "nsq"),
+		attribute.String("messaging.destination", sub.topic),
+		attribute.String("messaging.nsq.channel", sub.channel),
+	}
+	if m, ok := task.(*job.Message); ok {
+		attrs = append(attrs, attribute.String("job.timeout", m.Timeout.String()))
+	}
+	if msg != nil {
+		attrs = append(attrs,
+			attribute.String("messaging.message_id", string(msg.ID[:])),
+			attribute.Int("messaging.nsq.attempts", int(msg.Attempts)),
+		)
+		if len(carrier) > 0 {
+			ctx = propagator.Extract(ctx, propagation.MapCarrier(carrier))
+		}
+	}
+
+	return w.tracer.Start(ctx, sub.topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}